@@ -0,0 +1,119 @@
+package app
+
+import (
+	"github.com/golang/geo/s1"
+	"github.com/golang/geo/s2"
+	"github.com/golang/glog"
+	"math"
+	"sort"
+	"time"
+)
+
+// refine fetches the area quadtree-style: every cell whose travel time to a destination differs from
+// a neighbouring cell of the same size by more than the job threshold is replaced with its children.
+// Cells differing most are refined first when the element budget doesn't allow refining all of them.
+func (f *fetcher) refine(cells []cell, results []Result) []Result {
+	minStep := s1.Angle(float64(f.job.MinStepMeters) / earthRadius)
+	elementsPerCell := len(f.job.Destinations) * len(f.sweep)
+
+	for level := 1; len(cells) > 0; level++ {
+		durations := make(map[string]map[s2.LatLng]time.Duration)
+		for _, r := range results {
+			if !r.ok() {
+				// an unreachable cell next to a reachable one is an infinite difference
+				continue
+			}
+			key := latLonToString(r.Center)
+			if durations[key] == nil {
+				durations[key] = make(map[s2.LatLng]time.Duration)
+			}
+			durations[key][r.Destination] = r.Duration
+		}
+
+		levelCells := make(map[string]bool, len(cells))
+		for _, c := range cells {
+			levelCells[latLonToString(c.center())] = true
+		}
+
+		type candidate struct {
+			cell cell
+			diff time.Duration
+		}
+
+		var candidates []candidate
+		for _, c := range cells {
+			if c.size()/2 < minStep {
+				continue
+			}
+
+			var diff time.Duration
+			for _, n := range c.neighbours() {
+				if !levelCells[latLonToString(n)] {
+					// the neighbour is outside the area or of another size
+					continue
+				}
+				if d := f.durationDiff(durations[latLonToString(c.center())], durations[latLonToString(n)]); d > diff {
+					diff = d
+				}
+			}
+			if diff > f.job.AdaptiveThreshold {
+				candidates = append(candidates, candidate{c, diff})
+			}
+		}
+
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i].diff > candidates[j].diff })
+
+		refined := make(map[s2.LatLng]bool, len(candidates))
+		var children []cell
+		for i, c := range candidates {
+			subdivided := f.job.inArea(c.cell.subdivide())
+			if f.job.MaxElements > 0 && f.elements+(len(children)+len(subdivided))*elementsPerCell > f.job.MaxElements {
+				glog.Infof("Element budget allows refining %d/%d cells", i, len(candidates))
+				break
+			}
+
+			refined[c.cell.center()] = true
+			children = append(children, subdivided...)
+		}
+
+		if len(refined) == 0 {
+			break
+		}
+
+		glog.Infof("Refinement level %d: subdividing %d cells", level, len(refined))
+
+		var kept []Result
+		for _, r := range results {
+			if !refined[r.Center] {
+				kept = append(kept, r)
+			}
+		}
+		results = append(kept, f.fetch(children)...)
+		cells = children
+	}
+
+	return results
+}
+
+// durationDiff returns the largest difference of travel times of two cells to the same destination.
+// A destination reachable from one cell only is an infinite difference.
+func (f *fetcher) durationDiff(a, b map[s2.LatLng]time.Duration) time.Duration {
+	var diff time.Duration
+	for _, dest := range f.job.Destinations {
+		da, okA := a[dest]
+		db, okB := b[dest]
+
+		switch {
+		case okA != okB:
+			return math.MaxInt64
+		case okA && okB:
+			if d := da - db; d > diff {
+				diff = d
+			} else if -d > diff {
+				diff = -d
+			}
+		}
+	}
+
+	return diff
+}
@@ -0,0 +1,302 @@
+package app
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/golang/geo/s2"
+	"github.com/pkg/errors"
+	"github.com/twpayne/go-kml"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Area is a region of interest bounded by polygons, possibly with holes.
+// A point is in the area if it is inside an odd number of its rings.
+type Area struct {
+	// Rings are the outer boundaries and the holes of the polygons, without closing vertices.
+	Rings   [][]s2.LatLng
+	polygon *s2.Polygon
+	bound   s2.Rect
+}
+
+func NewArea(rings [][]s2.LatLng) (*Area, error) {
+	if len(rings) == 0 {
+		return nil, errors.New("no polygons in area")
+	}
+
+	loops := make([]*s2.Loop, len(rings))
+	for i, ring := range rings {
+		if len(ring) < 3 {
+			return nil, fmt.Errorf("ring %d has %d vertices, at least 3 expected", i, len(ring))
+		}
+
+		points := make([]s2.Point, len(ring))
+		for j, ll := range ring {
+			points[j] = s2.PointFromLatLng(ll)
+		}
+
+		// the orientation of rings differs between formats and editors, so every ring is taken as the smaller region
+		loops[i] = s2.LoopFromPoints(points)
+		loops[i].Normalize()
+	}
+
+	polygon := s2.PolygonFromLoops(loops)
+	if err := polygon.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid area polygon")
+	}
+
+	// the polygon bound of several loops always includes the zero point, so the bound is collected from the loops
+	bound := s2.EmptyRect()
+	for _, loop := range polygon.Loops() {
+		if !loop.IsHole() {
+			bound = bound.Union(loop.RectBound())
+		}
+	}
+
+	return &Area{Rings: rings, polygon: polygon, bound: bound}, nil
+}
+
+// LoadArea loads the polygons and multipolygons of a KML or GeoJSON file, depending on its extension.
+func LoadArea(path string) (*Area, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to open area %q", path))
+	}
+	defer file.Close()
+
+	var rings [][]s2.LatLng
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".kml":
+		rings, err = readKmlRings(file)
+	case ".geojson", ".json":
+		rings, err = readGeoJSONRings(file)
+	default:
+		return nil, fmt.Errorf("unknown area format %q, KML or GeoJSON expected", path)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to read area %q", path))
+	}
+
+	return NewArea(rings)
+}
+
+func (a *Area) UnmarshalJSON(data []byte) error {
+	var stored struct {
+		Rings [][]s2.LatLng
+	}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+
+	area, err := NewArea(stored.Rings)
+	if err != nil {
+		return err
+	}
+	*a = *area
+
+	return nil
+}
+
+// Contains reports whether the point is in the area.
+func (a *Area) Contains(ll s2.LatLng) bool {
+	return a.polygon.ContainsPoint(s2.PointFromLatLng(ll))
+}
+
+// Bounds returns the south-west and north-east corners of the area bounding rectangle.
+func (a *Area) Bounds() (s2.LatLng, s2.LatLng) {
+	return a.bound.Lo(), a.bound.Hi()
+}
+
+// kml returns the polygons of the area with their holes.
+func (a *Area) kml() *kml.CompoundElement {
+	geometry := kml.MultiGeometry()
+
+	loops := a.polygon.Loops()
+	for k, loop := range loops {
+		if loop.IsHole() {
+			continue
+		}
+
+		polygon := kml.Polygon(kml.OuterBoundaryIs(kml.LinearRing(kml.Coordinates(loopCoordinates(loop)...))))
+		// loops are ordered by nesting, the holes of the shell follow it along with the islands inside them
+		for j := k + 1; j <= a.polygon.LastDescendant(k); j = a.polygon.LastDescendant(j) + 1 {
+			polygon.Add(kml.InnerBoundaryIs(kml.LinearRing(kml.Coordinates(loopCoordinates(loops[j])...))))
+		}
+		geometry.Add(polygon)
+	}
+
+	return geometry
+}
+
+func loopCoordinates(loop *s2.Loop) []kml.Coordinate {
+	var coordinates []kml.Coordinate
+	for _, v := range loop.Vertices() {
+		ll := s2.LatLngFromPoint(v)
+		coordinates = append(coordinates, kml.Coordinate{Lat: ll.Lat.Degrees(), Lon: ll.Lng.Degrees()})
+	}
+
+	return append(coordinates, coordinates[0])
+}
+
+// readKmlRings returns the rings of every polygon in the KML document.
+func readKmlRings(r io.Reader) ([][]s2.LatLng, error) {
+	var rings [][]s2.LatLng
+	var inRing, inCoordinates bool
+	var coordinates strings.Builder
+
+	decoder := xml.NewDecoder(r)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse KML")
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "LinearRing":
+				inRing = true
+			case "coordinates":
+				inCoordinates = inRing
+				coordinates.Reset()
+			}
+		case xml.CharData:
+			if inCoordinates {
+				coordinates.Write(t)
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "LinearRing":
+				inRing = false
+			case "coordinates":
+				if !inCoordinates {
+					continue
+				}
+				inCoordinates = false
+
+				ring, err := parseKmlCoordinates(coordinates.String())
+				if err != nil {
+					return nil, err
+				}
+				rings = append(rings, ring)
+			}
+		}
+	}
+
+	return rings, nil
+}
+
+// parseKmlCoordinates parses whitespace separated "lon,lat[,alt]" tuples.
+func parseKmlCoordinates(s string) ([]s2.LatLng, error) {
+	var positions [][]float64
+	for _, tuple := range strings.Fields(s) {
+		var position []float64
+		for _, v := range strings.Split(tuple, ",") {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid KML coordinates %q", tuple)
+			}
+			position = append(position, f)
+		}
+		positions = append(positions, position)
+	}
+
+	return positionsToRing(positions)
+}
+
+type geoJSONObject struct {
+	Type        string
+	Coordinates json.RawMessage
+	Geometry    *geoJSONObject
+	Geometries  []geoJSONObject
+	Features    []geoJSONObject
+}
+
+// readGeoJSONRings returns the rings of every Polygon and MultiPolygon in the GeoJSON object.
+func readGeoJSONRings(r io.Reader) ([][]s2.LatLng, error) {
+	var object geoJSONObject
+	if err := json.NewDecoder(r).Decode(&object); err != nil {
+		return nil, errors.Wrap(err, "failed to parse GeoJSON")
+	}
+
+	return object.rings()
+}
+
+func (o geoJSONObject) rings() ([][]s2.LatLng, error) {
+	var polygons [][][][]float64
+
+	switch o.Type {
+	case "FeatureCollection":
+		return geoJSONRings(o.Features)
+	case "GeometryCollection":
+		return geoJSONRings(o.Geometries)
+	case "Feature":
+		if o.Geometry == nil {
+			return nil, nil
+		}
+		return o.Geometry.rings()
+	case "Polygon":
+		var polygon [][][]float64
+		if err := json.Unmarshal(o.Coordinates, &polygon); err != nil {
+			return nil, errors.Wrap(err, "invalid Polygon coordinates")
+		}
+		polygons = append(polygons, polygon)
+	case "MultiPolygon":
+		if err := json.Unmarshal(o.Coordinates, &polygons); err != nil {
+			return nil, errors.Wrap(err, "invalid MultiPolygon coordinates")
+		}
+	default:
+		// points and lines don't bound an area
+		return nil, nil
+	}
+
+	var rings [][]s2.LatLng
+	for _, polygon := range polygons {
+		for _, positions := range polygon {
+			ring, err := positionsToRing(positions)
+			if err != nil {
+				return nil, err
+			}
+			rings = append(rings, ring)
+		}
+	}
+
+	return rings, nil
+}
+
+func geoJSONRings(objects []geoJSONObject) ([][]s2.LatLng, error) {
+	var rings [][]s2.LatLng
+	for _, o := range objects {
+		r, err := o.rings()
+		if err != nil {
+			return nil, err
+		}
+		rings = append(rings, r...)
+	}
+
+	return rings, nil
+}
+
+// positionsToRing converts [lon, lat] positions of a closed ring into vertices without the closing one.
+func positionsToRing(positions [][]float64) ([]s2.LatLng, error) {
+	var ring []s2.LatLng
+	for _, p := range positions {
+		if len(p) < 2 {
+			return nil, fmt.Errorf("invalid position %v", p)
+		}
+		ring = append(ring, s2.LatLngFromDegrees(p[1], p[0]))
+	}
+
+	if len(ring) > 1 && ring[0] == ring[len(ring)-1] {
+		ring = ring[:len(ring)-1]
+	}
+
+	return ring, nil
+}
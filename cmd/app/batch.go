@@ -0,0 +1,83 @@
+package app
+
+import (
+	"github.com/golang/geo/s2"
+)
+
+const (
+	// maxDimension is the max number of origins or destinations in a Distance Matrix request.
+	maxDimension = 25
+	// maxElements is the max number of origin-destination pairs in a Distance Matrix request.
+	maxElements = 100
+)
+
+// batch is a set of origins and destinations fetched with a single request.
+type batch struct {
+	origins, destinations []s2.LatLng
+	opts                  Options
+}
+
+// packBatches packs every origin-destination pair into requests that fit the Distance Matrix limits.
+// Destinations are split into even groups, and every group is paired with as many origins as fit.
+func packBatches(origins, destinations []s2.LatLng) []batch {
+	var batches []batch
+
+	for _, dests := range splitDestinations(destinations) {
+		size := originsPerBatch(len(dests))
+		for i := 0; i < len(origins); i += size {
+			end := i + size
+			if end > len(origins) {
+				end = len(origins)
+			}
+
+			batches = append(batches, batch{origins: origins[i:end], destinations: dests})
+		}
+	}
+
+	return batches
+}
+
+// countBatches returns the number of batches packBatches yields.
+func countBatches(origins, destinations int) int {
+	var count int
+
+	groups := (destinations + maxDimension - 1) / maxDimension
+	for g := 0; g < groups; g++ {
+		size := originsPerBatch(groupSize(destinations, groups, g))
+		count += (origins + size - 1) / size
+	}
+
+	return count
+}
+
+func splitDestinations(destinations []s2.LatLng) [][]s2.LatLng {
+	var result [][]s2.LatLng
+
+	groups := (len(destinations) + maxDimension - 1) / maxDimension
+	for g, start := 0, 0; g < groups; g++ {
+		end := start + groupSize(len(destinations), groups, g)
+		result = append(result, destinations[start:end])
+		start = end
+	}
+
+	return result
+}
+
+// groupSize returns the size of the g-th of the groups the destinations are evenly split into.
+func groupSize(destinations, groups, g int) int {
+	size := destinations / groups
+	if g < destinations%groups {
+		size++
+	}
+
+	return size
+}
+
+func originsPerBatch(destinations int) int {
+	size := maxElements / destinations
+	if size > maxDimension {
+		size = maxDimension
+	}
+
+	return size
+}
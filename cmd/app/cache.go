@@ -0,0 +1,253 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/geo/s2"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TravelTimeCache is a persistent cache of travel times, stored as an append-only file of JSON lines.
+type TravelTimeCache struct {
+	ttl time.Duration
+
+	mu           sync.Mutex
+	file         *os.File
+	entries      map[string]cacheEntry
+	hits, misses int
+}
+
+type cacheEntry struct {
+	Key        string
+	FetchedAt  time.Time
+	TravelTime TravelTime
+}
+
+// OpenTravelTimeCache opens the cache file, creating it if needed. Entries older than ttl are ignored;
+// a zero ttl means entries never expire. The file is compacted if it has expired, overwritten or unroutable entries.
+func OpenTravelTimeCache(path string, ttl time.Duration) (*TravelTimeCache, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to open cache %q", path))
+	}
+
+	c := &TravelTimeCache{ttl: ttl, file: file, entries: make(map[string]cacheEntry)}
+
+	lines, err := loadJSONLines(file, func(line []byte) error {
+		var entry cacheEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return errors.Wrap(err, "failed to unmarshal cache entry")
+		}
+		c.entries[entry.Key] = entry
+		return nil
+	})
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to load cache %q", path))
+	}
+
+	for key, entry := range c.entries {
+		// caches of older versions have unroutable elements
+		if c.expired(entry) || entry.TravelTime.Status != StatusOK {
+			delete(c.entries, key)
+		}
+	}
+	if lines > len(c.entries) {
+		glog.Infof("Compacting cache %s: %d entries of %d", path, len(c.entries), lines)
+		if err := c.compact(); err != nil {
+			c.file.Close()
+			return nil, errors.Wrap(err, fmt.Sprintf("failed to compact cache %q", path))
+		}
+	}
+
+	return c, nil
+}
+
+func (c *TravelTimeCache) expired(entry cacheEntry) bool {
+	return c.ttl > 0 && time.Since(entry.FetchedAt) > c.ttl
+}
+
+// compact rewrites the file with the loaded entries only, in the order they were fetched.
+func (c *TravelTimeCache) compact() error {
+	entries := make([]cacheEntry, 0, len(c.entries))
+	for _, entry := range c.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].FetchedAt.Equal(entries[j].FetchedAt) {
+			return entries[i].FetchedAt.Before(entries[j].FetchedAt)
+		}
+		return entries[i].Key < entries[j].Key
+	})
+
+	file, err := rewriteJSONLines(c.file, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.file = file
+
+	return nil
+}
+
+func (c *TravelTimeCache) get(key string) (TravelTime, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if ok && c.expired(entry) {
+		ok = false
+	}
+
+	if ok {
+		c.hits++
+	} else {
+		c.misses++
+	}
+
+	return entry.TravelTime, ok
+}
+
+func (c *TravelTimeCache) put(key string, tt TravelTime) error {
+	entry := cacheEntry{Key: key, FetchedAt: time.Now(), TravelTime: tt}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal cache entry")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := c.file.Write(append(data, '\n')); err != nil {
+		return errors.Wrap(err, "failed to write cache entry")
+	}
+	c.entries[key] = entry
+
+	return nil
+}
+
+// Stats returns the number of origin-destination pairs found in and missing from the cache.
+func (c *TravelTimeCache) Stats() (hits, misses int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.hits, c.misses
+}
+
+func (c *TravelTimeCache) Close() error {
+	return c.file.Close()
+}
+
+// CachingProvider is a TravelTimeProvider that serves travel times from the cache
+// and requests only uncached origins from the underlying provider. Only routable elements are cached.
+type CachingProvider struct {
+	name     string
+	provider TravelTimeProvider
+	cache    *TravelTimeCache
+}
+
+// NewCachingProvider wraps the provider with the cache. The name separates cached entries of different providers.
+func NewCachingProvider(name string, provider TravelTimeProvider, cache *TravelTimeCache) *CachingProvider {
+	return &CachingProvider{name: name, provider: provider, cache: cache}
+}
+
+func (p *CachingProvider) ValidateOptions(opts Options) error {
+	return validateOptions(p.provider, opts)
+}
+
+func (p *CachingProvider) TravelTimes(ctx context.Context, origins, destinations []s2.LatLng, opts Options) ([][]TravelTime, error) {
+	optsKey := opts.cacheKey()
+
+	matrix := make([][]TravelTime, len(origins))
+	var missing []int
+
+	for i, origin := range origins {
+		matrix[i] = make([]TravelTime, len(destinations))
+		cached := true
+		for j, dest := range destinations {
+			tt, ok := p.cache.get(p.key(origin, dest, optsKey))
+			matrix[i][j] = tt
+			cached = cached && ok
+		}
+		if !cached {
+			missing = append(missing, i)
+		}
+	}
+
+	if len(missing) == 0 {
+		return matrix, nil
+	}
+
+	missingOrigins := make([]s2.LatLng, len(missing))
+	for k, i := range missing {
+		missingOrigins[k] = origins[i]
+	}
+
+	fetched, err := p.provider.TravelTimes(ctx, missingOrigins, destinations, opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(fetched) != len(missing) {
+		return nil, fmt.Errorf("len(missingOrigins) != len(fetched): %d != %d ", len(missing), len(fetched))
+	}
+
+	for k, i := range missing {
+		matrix[i] = fetched[k]
+		for j, dest := range destinations {
+			if j >= len(fetched[k]) {
+				break
+			}
+			if fetched[k][j].Status != StatusOK {
+				// unroutable elements are requested again, e.g. when the failed cells are retried
+				continue
+			}
+			if err := p.cache.put(p.key(origins[i], dest, optsKey), fetched[k][j]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return matrix, nil
+}
+
+func (p *CachingProvider) key(origin, dest s2.LatLng, optsKey string) string {
+	return fmt.Sprintf("%s|%.5f,%.5f|%.5f,%.5f|%s",
+		p.name, origin.Lat.Degrees(), origin.Lng.Degrees(), dest.Lat.Degrees(), dest.Lng.Degrees(), optsKey)
+}
+
+// cacheKey returns the options in a normalized form, so that equivalent options share cached travel times.
+func (o Options) cacheKey() string {
+	var transitModes []string
+	if o.TransitMode != "" {
+		transitModes = strings.Split(strings.ToLower(o.TransitMode), "|")
+		sort.Strings(transitModes)
+	}
+
+	return strings.Join([]string{
+		strings.ToLower(o.Mode),
+		o.Language,
+		strings.ToLower(o.Avoid),
+		strings.ToLower(o.Units),
+		getTime(o.DepartureTime),
+		getTime(o.ArrivalTime),
+		strings.Join(transitModes, "|"),
+		strings.ToLower(o.TransitRoutingPreference),
+		strings.ToLower(o.TrafficModel),
+	}, ";")
+}
@@ -0,0 +1,185 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"googlemaps.github.io/maps"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+)
+
+// credentialParams are stripped from recorded requests, so cassettes can be shared and replayed with any key.
+var credentialParams = []string{"key", "client", "signature", "channel"}
+
+// Interaction is a single recorded API request and its raw response.
+type Interaction struct {
+	// Request is the request path and its query without credentials.
+	Request string
+	Status  int
+	// Response is the body of the response if it is JSON, as API responses are.
+	Response json.RawMessage `json:",omitempty"`
+	// Body is any other body, e.g. an error page of a proxy, along with its ContentType.
+	Body        string `json:",omitempty"`
+	ContentType string `json:",omitempty"`
+}
+
+// CassetteRecorder is an http.RoundTripper that appends every API request and response to a cassette file.
+type CassetteRecorder struct {
+	base http.RoundTripper
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewCassetteRecorder(path string) (*CassetteRecorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to open cassette %q", path))
+	}
+
+	return &CassetteRecorder{base: http.DefaultTransport, file: file}, nil
+}
+
+// ClientOption routes the maps client traffic through the recorder.
+func (r *CassetteRecorder) ClientOption() maps.ClientOption {
+	return maps.WithHTTPClient(&http.Client{Transport: r})
+}
+
+func (r *CassetteRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := r.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read response")
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	interaction := Interaction{Request: interactionKey(req.URL), Status: resp.StatusCode}
+	if json.Valid(body) {
+		interaction.Response = json.RawMessage(body)
+	} else {
+		interaction.Body, interaction.ContentType = string(body), resp.Header.Get("Content-Type")
+	}
+
+	data, err := json.Marshal(interaction)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal interaction")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, err := r.file.Write(append(data, '\n')); err != nil {
+		return nil, errors.Wrap(err, "failed to write cassette")
+	}
+
+	return resp, nil
+}
+
+func (r *CassetteRecorder) Close() error {
+	return r.file.Close()
+}
+
+// CassettePlayer is a local HTTP stand-in for the Google Maps API that serves responses from a cassette file.
+// Identical requests are answered with their recorded responses in order, the last one being repeated.
+type CassettePlayer struct {
+	server *httptest.Server
+
+	mu           sync.Mutex
+	interactions map[string][]Interaction
+}
+
+func NewCassettePlayer(path string) (*CassettePlayer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to open cassette %q", path))
+	}
+	defer file.Close()
+
+	p := &CassettePlayer{interactions: make(map[string][]Interaction)}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var interaction Interaction
+		if err := json.Unmarshal(scanner.Bytes(), &interaction); err != nil {
+			return nil, errors.Wrap(err, "failed to unmarshal interaction")
+		}
+		p.interactions[interaction.Request] = append(p.interactions[interaction.Request], interaction)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to read cassette %q", path))
+	}
+
+	p.server = httptest.NewServer(http.HandlerFunc(p.serve))
+
+	return p, nil
+}
+
+// ClientOption points the maps client to the player.
+func (p *CassettePlayer) ClientOption() maps.ClientOption {
+	return maps.WithBaseURL(p.server.URL)
+}
+
+func (p *CassettePlayer) serve(w http.ResponseWriter, req *http.Request) {
+	key := interactionKey(req.URL)
+
+	p.mu.Lock()
+	recorded := p.interactions[key]
+	if len(recorded) > 1 {
+		p.interactions[key] = recorded[1:]
+	}
+	p.mu.Unlock()
+
+	if len(recorded) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":        "NOT_RECORDED",
+			"error_message": fmt.Sprintf("cassette has no response for %s", key),
+		})
+		return
+	}
+
+	interaction := recorded[0]
+	if interaction.Response == nil {
+		if interaction.ContentType != "" {
+			w.Header().Set("Content-Type", interaction.ContentType)
+		}
+		w.WriteHeader(interaction.Status)
+		w.Write([]byte(interaction.Body))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(interaction.Status)
+	w.Write(interaction.Response)
+}
+
+func (p *CassettePlayer) Close() error {
+	p.server.Close()
+	return nil
+}
+
+func interactionKey(u *url.URL) string {
+	q := u.Query()
+	for _, param := range credentialParams {
+		q.Del(param)
+	}
+
+	return u.Path + "?" + q.Encode()
+}
@@ -0,0 +1,162 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"github.com/golang/geo/s2"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestReplay fetches a small area from a recorded cassette and renders it, the way CI runs fetches offline.
+func TestReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	player, err := NewCassettePlayer(filepath.Join("testdata", "replay.cassette"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer player.Close()
+
+	provider, err := NewGoogleProvider("replay", player.ClientOption())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := FetchJob{
+		Destinations: []s2.LatLng{s2.LatLngFromDegrees(55.801, 37.601)},
+		AreaStart:    s2.LatLngFromDegrees(55.69, 37.59),
+		AreaEnd:      s2.LatLngFromDegrees(55.705, 37.615),
+		StepMeters:   1000,
+		Options:      Options{Mode: "transit"},
+		Provider:     "google",
+	}
+
+	results := filepath.Join(dir, "results.json")
+	if err := FetchResults(provider, job, nil, results); err != nil {
+		t.Fatalf("FetchResults: %v", err)
+	}
+
+	container, err := ReadResults(results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(container.Results) != 4 {
+		t.Fatalf("got %d results, want 4", len(container.Results))
+	}
+
+	durations := make(map[string]time.Duration)
+	statuses := make(map[string]string)
+	for _, r := range container.Results {
+		durations[latLonToString(r.Center)] = r.Duration
+		statuses[latLonToString(r.Center)] = r.Status
+	}
+	for center, want := range map[string]time.Duration{
+		"55.690000,37.590000": 10 * time.Minute,
+		"55.690000,37.605982": 15 * time.Minute,
+		"55.698983,37.590000": 20 * time.Minute,
+	} {
+		if durations[center] != want || statuses[center] != StatusOK {
+			t.Errorf("%s: got %v %s, want %v OK", center, durations[center], statuses[center], want)
+		}
+	}
+	if status := statuses["55.698983,37.605982"]; status != "ZERO_RESULTS" {
+		t.Errorf("55.698983,37.605982: got status %q, want ZERO_RESULTS", status)
+	}
+
+	kml := filepath.Join(dir, "results.kml")
+	if err := RenderKml(results, kml, time.Hour, 6, StatisticMedian); err != nil {
+		t.Fatalf("RenderKml: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(kml)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"10 min", "15 min", "20 min", "ZERO_RESULTS"} {
+		if n := bytes.Count(data, []byte("<name>"+name+"</name>")); n != 1 {
+			t.Errorf("got %d cells named %q, want 1", n, name)
+		}
+	}
+}
+
+// TestReplayNotRecorded checks that a request missing from the cassette fails instead of reaching the API.
+func TestReplayNotRecorded(t *testing.T) {
+	player, err := NewCassettePlayer(filepath.Join("testdata", "replay.cassette"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer player.Close()
+
+	provider, err := NewGoogleProvider("replay", player.ClientOption())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	origins := []s2.LatLng{s2.LatLngFromDegrees(1, 2)}
+	destinations := []s2.LatLng{s2.LatLngFromDegrees(3, 4)}
+	if _, err := provider.TravelTimes(context.Background(), origins, destinations, Options{Mode: "transit"}); err == nil {
+		t.Fatal("got no error for a request missing from the cassette")
+	}
+}
+
+// TestRecordNonJSON checks that a response that isn't JSON, e.g. an error page of a proxy, is recorded and replayed.
+func TestRecordNonJSON(t *testing.T) {
+	const page = "<html><body>502 Bad Gateway</body></html>"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(page))
+	}))
+	defer server.Close()
+
+	cassette, err := ioutil.TempFile("", "cassette")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cassette.Close()
+	defer os.Remove(cassette.Name())
+
+	recorder, err := NewCassetteRecorder(cassette.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const request = "/maps/api/distancematrix/json?origins=1%2C2"
+	resp, err := (&http.Client{Transport: recorder}).Get(server.URL + request + "&key=secret")
+	if err != nil {
+		t.Fatalf("recording: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway || string(body) != page {
+		t.Fatalf("recording: got %d %q, want 502 %q", resp.StatusCode, body, page)
+	}
+	recorder.Close()
+
+	player, err := NewCassettePlayer(cassette.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer player.Close()
+
+	resp, err = http.Get(player.server.URL + request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway || string(body) != page || resp.Header.Get("Content-Type") != "text/html" {
+		t.Errorf("replay: got %d %q %s, want 502 %q text/html", resp.StatusCode, body, resp.Header.Get("Content-Type"), page)
+	}
+}
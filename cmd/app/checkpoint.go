@@ -0,0 +1,254 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/geo/s2"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Checkpoint is an append-only file of fetched batches, one JSON object per line.
+// It allows an interrupted fetch to be resumed without requesting the same origins again.
+// The first line is the header with the parameters of the job, so that a different job can't resume from it.
+type Checkpoint struct {
+	mu      sync.Mutex
+	file    *os.File
+	params  checkpointParams
+	header  *checkpointParams
+	fetched map[string]bool
+	// fetchedOrigins are the origins of batches written before checkpoints recorded destinations and times,
+	// fetched for the only destination of such jobs.
+	fetchedOrigins map[string]bool
+	results        []Result
+}
+
+// checkpointParams are the parameters of a job that the fetched travel times depend on.
+type checkpointParams struct {
+	Provider               string
+	Destinations           []s2.LatLng
+	Direction              Direction
+	Options                Options
+	Grid                   Grid
+	StepMeters             int
+	S2Level                int
+	SweepWindow, SweepStep time.Duration
+}
+
+type checkpointHeader struct {
+	Params *checkpointParams
+}
+
+type checkpointBatch struct {
+	Origins       []s2.LatLng
+	Destinations  []s2.LatLng
+	DepartureTime time.Time
+	ArrivalTime   time.Time
+	Results       []Result
+}
+
+// OpenCheckpoint opens the checkpoint file of the job. If resume is true, batches already in the file are loaded
+// and new ones are appended after them, provided the file was written by the same job.
+// Otherwise the file has to be empty or missing unless overwrite is true, then it is truncated.
+func OpenCheckpoint(path string, job FetchJob, resume, overwrite bool) (*Checkpoint, error) {
+	flags := os.O_CREATE | os.O_RDWR
+	if !resume {
+		if info, err := os.Stat(path); err == nil && info.Size() > 0 && !overwrite {
+			return nil, fmt.Errorf("checkpoint %q has fetched batches, resume from it or overwrite it", path)
+		}
+		flags |= os.O_TRUNC
+	}
+
+	file, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to open checkpoint %q", path))
+	}
+
+	c := &Checkpoint{
+		file:           file,
+		params:         job.checkpointParams(),
+		fetched:        make(map[string]bool),
+		fetchedOrigins: make(map[string]bool),
+	}
+	if err := c.load(); err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to load checkpoint %q", path))
+	}
+	if err := c.checkHeader(); err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, fmt.Sprintf("checkpoint %q", path))
+	}
+
+	return c, nil
+}
+
+func (j FetchJob) checkpointParams() checkpointParams {
+	return checkpointParams{
+		Provider:     j.Provider,
+		Destinations: j.Destinations,
+		Direction:    j.Direction,
+		Options:      j.Options,
+		Grid:         j.Grid,
+		StepMeters:   j.StepMeters,
+		S2Level:      j.S2Level,
+		SweepWindow:  j.SweepWindow,
+		SweepStep:    j.SweepStep,
+	}
+}
+
+// load reads the header and the batches stored in the file.
+func (c *Checkpoint) load() error {
+	_, err := loadJSONLines(c.file, func(line []byte) error {
+		var header checkpointHeader
+		if err := json.Unmarshal(line, &header); err == nil && header.Params != nil {
+			c.header = header.Params
+			return nil
+		}
+
+		var batch checkpointBatch
+		if err := json.Unmarshal(line, &batch); err != nil {
+			return errors.Wrap(err, "failed to unmarshal checkpoint batch")
+		}
+
+		if batch.Destinations == nil {
+			c.loadOriginBatch(batch)
+			return nil
+		}
+
+		opts := Options{DepartureTime: batch.DepartureTime, ArrivalTime: batch.ArrivalTime}
+		for _, origin := range batch.Origins {
+			for _, dest := range batch.Destinations {
+				c.fetched[checkpointKey(origin, dest, opts)] = true
+			}
+		}
+		c.results = append(c.results, batch.Results...)
+
+		return nil
+	})
+
+	return err
+}
+
+// loadOriginBatch loads a batch of the format without destinations and times. Its results have no destination,
+// they get the one of the job if it has a single destination.
+func (c *Checkpoint) loadOriginBatch(batch checkpointBatch) {
+	for _, origin := range batch.Origins {
+		c.fetchedOrigins[latLonToString(origin)] = true
+	}
+
+	for _, r := range batch.Results {
+		if r.Destination == (s2.LatLng{}) && len(c.params.Destinations) == 1 {
+			r.Destination = c.params.Destinations[0]
+		}
+		c.results = append(c.results, r)
+	}
+}
+
+// checkHeader compares the header of the file to the parameters of the job, writing it to a new file.
+func (c *Checkpoint) checkHeader() error {
+	if c.header == nil {
+		if len(c.results) > 0 {
+			glog.Warningf("Checkpoint %s has no job parameters, make sure it was written by the same job", c.file.Name())
+			return nil
+		}
+
+		data, err := json.Marshal(checkpointHeader{Params: &c.params})
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal checkpoint header")
+		}
+		if _, err := c.file.Write(append(data, '\n')); err != nil {
+			return errors.Wrap(err, "failed to write checkpoint header")
+		}
+
+		return nil
+	}
+
+	if diff := c.params.diff(*c.header); len(diff) > 0 {
+		return fmt.Errorf("was written by a different job, %s differ", strings.Join(diff, ", "))
+	}
+
+	return nil
+}
+
+// diff returns the names of the parameters that differ, comparing them in their JSON form.
+func (p checkpointParams) diff(other checkpointParams) []string {
+	var fields [2]map[string]json.RawMessage
+	for i, params := range []checkpointParams{p, other} {
+		data, _ := json.Marshal(params)
+		json.Unmarshal(data, &fields[i])
+	}
+
+	var names []string
+	for name, value := range fields[0] {
+		if !bytes.Equal(value, fields[1][name]) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// IsFetched reports whether the origin-destination pair was fetched in a previous run
+// at the departure or arrival time of opts.
+func (c *Checkpoint) IsFetched(origin, dest s2.LatLng, opts Options) bool {
+	return c.fetched[checkpointKey(origin, dest, opts)] || c.fetchedOrigins[latLonToString(origin)]
+}
+
+// pending returns the batch without the origins fetched for all its destinations in a previous run.
+func (c *Checkpoint) pending(b batch) batch {
+	var origins []s2.LatLng
+
+	for _, origin := range b.origins {
+		for _, dest := range b.destinations {
+			if !c.IsFetched(origin, dest, b.opts) {
+				origins = append(origins, origin)
+				break
+			}
+		}
+	}
+
+	return batch{origins: origins, destinations: b.destinations, opts: b.opts}
+}
+
+// Results returns the results loaded from the file.
+func (c *Checkpoint) Results() []Result {
+	return c.results
+}
+
+// Append stores a fetched batch along with its results.
+func (c *Checkpoint) Append(b batch, results []Result) error {
+	data, err := json.Marshal(checkpointBatch{
+		Origins:       b.origins,
+		Destinations:  b.destinations,
+		DepartureTime: b.opts.DepartureTime,
+		ArrivalTime:   b.opts.ArrivalTime,
+		Results:       results,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal checkpoint batch")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := c.file.Write(append(data, '\n')); err != nil {
+		return errors.Wrap(err, "failed to write checkpoint batch")
+	}
+
+	return nil
+}
+
+func (c *Checkpoint) Close() error {
+	return c.file.Close()
+}
+
+func checkpointKey(origin, dest s2.LatLng, opts Options) string {
+	return latLonToString(origin) + "|" + latLonToString(dest) + "|" + getTime(opts.DepartureTime) + "|" + getTime(opts.ArrivalTime)
+}
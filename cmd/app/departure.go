@@ -0,0 +1,127 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/pkg/errors"
+	"os"
+	"strings"
+	"time"
+)
+
+// TimeLayout is the layout of departure and arrival dates.
+const TimeLayout = "2006-01-02 15:04"
+
+const (
+	dateLayout  = "2006-01-02"
+	clockLayout = "15:04"
+
+	// maxSearchDays limits the search of the next date that isn't a holiday.
+	maxSearchDays = 366
+)
+
+// Holidays is a set of dates skipped by typical days, formatted as "2006-01-02".
+type Holidays map[string]bool
+
+// LoadHolidays reads holidays from a file with a date "2006-01-02" per line, optionally followed by its name.
+// Blank lines and lines starting with # are skipped.
+func LoadHolidays(path string) (Holidays, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to open holidays %q", path))
+	}
+	defer file.Close()
+
+	holidays := make(Holidays)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		date, err := time.Parse(dateLayout, strings.TrimSuffix(fields[0], ","))
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("holidays %q, line %d", path, line))
+		}
+		holidays[date.Format(dateLayout)] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to read holidays %q", path))
+	}
+
+	return holidays, nil
+}
+
+func (h Holidays) has(t time.Time) bool {
+	return h[t.Format(dateLayout)]
+}
+
+// ParseTime parses a time in loc: a date "2006-01-02 15:04" or a typical day with its time, "Tue 08:30" or
+// "weekday 08:30" for any day from Monday to Friday. A typical day is the next such date after now
+// that isn't a holiday.
+func ParseTime(s string, loc *time.Location, now time.Time, holidays Holidays) (time.Time, error) {
+	if t, err := time.ParseInLocation(TimeLayout, s, loc); err == nil {
+		return t, nil
+	}
+
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return time.Time{}, fmt.Errorf("invalid time %q, %q or a typical day like \"Tue 08:30\" expected", s, TimeLayout)
+	}
+
+	days, err := parseTypicalDay(fields[0])
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, fmt.Sprintf("invalid time %q", s))
+	}
+	clock, err := time.Parse(clockLayout, fields[1])
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, fmt.Sprintf("invalid time %q", s))
+	}
+
+	now = now.In(loc)
+	for i := 0; i <= maxSearchDays; i++ {
+		day := now.AddDate(0, 0, i)
+		t := time.Date(day.Year(), day.Month(), day.Day(), clock.Hour(), clock.Minute(), 0, 0, loc)
+		if days[t.Weekday()] && t.After(now) && !holidays.has(t) {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("every day of %q within a year is a holiday", s)
+}
+
+// parseTypicalDay returns the weekdays matching the name of a typical day.
+func parseTypicalDay(name string) (map[time.Weekday]bool, error) {
+	lower := strings.ToLower(name)
+	if lower == "weekday" {
+		return map[time.Weekday]bool{time.Monday: true, time.Tuesday: true, time.Wednesday: true, time.Thursday: true, time.Friday: true}, nil
+	}
+
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		full := strings.ToLower(d.String())
+		if lower == full || lower == full[:3] {
+			return map[time.Weekday]bool{d: true}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown day %q, a weekday name or \"weekday\" expected", name)
+}
+
+// NextOccurrence moves t by whole weeks to the first date after now that isn't a holiday,
+// keeping its weekday and local time. Times after now are returned as is.
+func (h Holidays) NextOccurrence(t, now time.Time) (time.Time, error) {
+	if t.After(now) {
+		return t, nil
+	}
+
+	weeks := int(now.Sub(t)/(7*24*time.Hour)) + 1
+	for i := 0; i <= maxSearchDays/7; i++ {
+		next := t.AddDate(0, 0, 7*(weeks+i))
+		if next.After(now) && !h.has(next) {
+			return next, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("every %s within a year is a holiday", t.Weekday())
+}
@@ -0,0 +1,133 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	moscow, err := time.LoadLocation("Europe/Moscow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		s        string
+		loc      *time.Location
+		now      time.Time
+		holidays Holidays
+		want     time.Time
+		wantErr  bool
+	}{
+		{name: "date", s: "2026-10-19 08:30", want: time.Date(2026, 10, 19, 8, 30, 0, 0, moscow)},
+		{name: "past date is kept", s: "2026-10-01 08:30", want: time.Date(2026, 10, 1, 8, 30, 0, 0, moscow)},
+		{name: "next day", s: "Sat 08:30", want: time.Date(2026, 10, 17, 8, 30, 0, 0, moscow)},
+		{name: "full day name", s: "saturday 08:30", want: time.Date(2026, 10, 17, 8, 30, 0, 0, moscow)},
+		{name: "today later", s: "Fri 13:00", want: time.Date(2026, 10, 16, 13, 0, 0, 0, moscow)},
+		{name: "today earlier", s: "Fri 08:30", want: time.Date(2026, 10, 23, 8, 30, 0, 0, moscow)},
+		{name: "next week", s: "Tue 08:30", want: time.Date(2026, 10, 20, 8, 30, 0, 0, moscow)},
+		{name: "weekday skips the weekend", s: "weekday 08:30", want: time.Date(2026, 10, 19, 8, 30, 0, 0, moscow)},
+		{name: "weekday holiday", s: "weekday 08:30", holidays: Holidays{"2026-10-19": true},
+			want: time.Date(2026, 10, 20, 8, 30, 0, 0, moscow)},
+		{name: "day holiday", s: "Mon 08:30", holidays: Holidays{"2026-10-19": true},
+			want: time.Date(2026, 10, 26, 8, 30, 0, 0, moscow)},
+		{name: "next month", s: "Mon 09:00", now: time.Date(2026, 10, 30, 12, 0, 0, 0, moscow),
+			want: time.Date(2026, 11, 2, 9, 0, 0, 0, moscow)},
+		{name: "next year past a holiday", s: "Fri 09:00", now: time.Date(2026, 12, 30, 12, 0, 0, 0, moscow),
+			holidays: Holidays{"2027-01-01": true}, want: time.Date(2027, 1, 8, 9, 0, 0, 0, moscow)},
+		{name: "daylight saving ends", s: "Mon 08:30", loc: berlin, now: time.Date(2026, 10, 23, 12, 0, 0, 0, berlin),
+			want: time.Date(2026, 10, 26, 8, 30, 0, 0, berlin)},
+		{name: "now is already Saturday in loc", s: "Sat 02:00", now: time.Date(2026, 10, 16, 22, 30, 0, 0, time.UTC),
+			want: time.Date(2026, 10, 17, 2, 0, 0, 0, moscow)},
+		{name: "unknown day", s: "Someday 08:30", wantErr: true},
+		{name: "invalid clock", s: "Tue 25:00", wantErr: true},
+		{name: "no clock", s: "Tue", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc, now := tt.loc, tt.now
+			if loc == nil {
+				loc = moscow
+			}
+			if now.IsZero() {
+				// Friday
+				now = time.Date(2026, 10, 16, 12, 0, 0, 0, moscow)
+			}
+
+			got, err := ParseTime(tt.s, loc, now, tt.holidays)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseTime(%q) = %v, want an error", tt.s, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseTime(%q): %v", tt.s, err)
+			}
+			if !got.Equal(tt.want) || got.Location() != loc {
+				t.Errorf("ParseTime(%q) = %v, want %v", tt.s, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextOccurrence(t *testing.T) {
+	moscow, err := time.LoadLocation("Europe/Moscow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Friday
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, moscow)
+
+	tests := []struct {
+		name     string
+		t, now   time.Time
+		holidays Holidays
+		want     time.Time
+	}{
+		{name: "future", t: time.Date(2026, 10, 19, 8, 30, 0, 0, moscow), now: now,
+			want: time.Date(2026, 10, 19, 8, 30, 0, 0, moscow)},
+		{name: "last week", t: time.Date(2026, 10, 12, 8, 30, 0, 0, moscow), now: now,
+			want: time.Date(2026, 10, 19, 8, 30, 0, 0, moscow)},
+		{name: "weeks ago", t: time.Date(2026, 9, 7, 8, 30, 0, 0, moscow), now: now,
+			want: time.Date(2026, 10, 19, 8, 30, 0, 0, moscow)},
+		{name: "holiday", t: time.Date(2026, 10, 12, 8, 30, 0, 0, moscow), now: now, holidays: Holidays{"2026-10-19": true},
+			want: time.Date(2026, 10, 26, 8, 30, 0, 0, moscow)},
+		{name: "now", t: now, now: now, want: time.Date(2026, 10, 23, 12, 0, 0, 0, moscow)},
+		{name: "next month", t: time.Date(2026, 10, 26, 8, 30, 0, 0, moscow), now: time.Date(2026, 10, 30, 12, 0, 0, 0, moscow),
+			want: time.Date(2026, 11, 2, 8, 30, 0, 0, moscow)},
+		{name: "daylight saving ends", t: time.Date(2026, 10, 19, 8, 30, 0, 0, berlin), now: time.Date(2026, 10, 23, 12, 0, 0, 0, berlin),
+			want: time.Date(2026, 10, 26, 8, 30, 0, 0, berlin)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.holidays.NextOccurrence(tt.t, tt.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("NextOccurrence(%v) = %v, want %v", tt.t, got, tt.want)
+			}
+		})
+	}
+
+	every := make(Holidays)
+	for d := 0; d <= maxSearchDays+7; d++ {
+		every[now.AddDate(0, 0, d).Format(dateLayout)] = true
+	}
+	if got, err := every.NextOccurrence(now, now); err == nil {
+		t.Errorf("NextOccurrence with every day a holiday = %v, want an error", got)
+	}
+}
@@ -0,0 +1,100 @@
+package app
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/pkg/errors"
+	"strconv"
+)
+
+// DiffResults compares the travel times of two results files cell by cell and writes them as CSV, one row
+// per cell and destination found in either file. The difference is the travel time of b minus that of a
+// in minutes; it is empty unless the cell is reachable in both files.
+func DiffResults(fileA, fileB, output string) error {
+	a, err := ReadResults(fileA)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to read file %q", fileA))
+	}
+	b, err := ReadResults(fileB)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to read file %q", fileB))
+	}
+
+	type row struct {
+		a, b *Result
+	}
+
+	var keys []resultKey
+	rows := make(map[resultKey]*row)
+	getRow := func(r Result) *row {
+		key := r.key()
+		if rows[key] == nil {
+			rows[key] = &row{}
+			keys = append(keys, key)
+		}
+		return rows[key]
+	}
+
+	for i := range a.Results {
+		getRow(a.Results[i]).a = &a.Results[i]
+	}
+	for i := range b.Results {
+		getRow(b.Results[i]).b = &b.Results[i]
+	}
+
+	out, err := createOutput(output)
+	if err != nil {
+		return err
+	}
+
+	w := csv.NewWriter(out)
+	w.Write([]string{"cell_lat", "cell_lng", "destination_lat", "destination_lng", "status_a", "status_b", "minutes_a", "minutes_b", "diff_minutes"})
+
+	for _, key := range keys {
+		r := rows[key]
+		record := make([]string, 9)
+
+		for _, res := range []*Result{r.a, r.b} {
+			if res != nil {
+				record[0], record[1] = formatDegrees(res.Center.Lat.Degrees()), formatDegrees(res.Center.Lng.Degrees())
+				record[2], record[3] = formatDegrees(res.Destination.Lat.Degrees()), formatDegrees(res.Destination.Lng.Degrees())
+			}
+		}
+		if r.a != nil {
+			record[4] = r.a.Status
+			if r.a.ok() {
+				record[6] = formatMinutes(r.a.Duration.Minutes())
+			}
+		}
+		if r.b != nil {
+			record[5] = r.b.Status
+			if r.b.ok() {
+				record[7] = formatMinutes(r.b.Duration.Minutes())
+			}
+		}
+		if r.a != nil && r.b != nil && r.a.ok() && r.b.ok() {
+			record[8] = formatMinutes((r.b.Duration - r.a.Duration).Minutes())
+		}
+
+		w.Write(record)
+	}
+
+	w.Flush()
+	err = w.Error()
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to write diff")
+	}
+
+	return nil
+}
+
+func formatDegrees(v float64) string {
+	return strconv.FormatFloat(v, 'f', 6, 64)
+}
+
+func formatMinutes(v float64) string {
+	return strconv.FormatFloat(v, 'f', 1, 64)
+}
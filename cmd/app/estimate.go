@@ -0,0 +1,153 @@
+package app
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultPricePerElement is the Distance Matrix price of a basic element in USD.
+	DefaultPricePerElement = 0.005
+
+	minStepMeters = 10
+)
+
+// FetchPlan is an estimate of the requests FetchResults makes and their cost.
+type FetchPlan struct {
+	StepMeters   int
+	Origins      int
+	Destinations int
+	// Elements counts every sampled departure time.
+	Elements int
+	Requests int
+	Cost     float64
+}
+
+func (p FetchPlan) String() string {
+	return fmt.Sprintf(
+		"step: %d m\norigins: %d\ndestinations: %d\nelements: %d\nrequests: %d\nestimated cost: $%.2f\n",
+		p.StepMeters, p.Origins, p.Destinations, p.Elements, p.Requests, p.Cost,
+	)
+}
+
+// Budget limits the number of elements or the money spent on a fetch. Zero fields are not limited.
+type Budget struct {
+	Elements int
+	Money    float64
+}
+
+// ParseBudget parses an element count, e.g. "10000", or an amount of money in USD, e.g. "$50".
+func ParseBudget(s string) (Budget, error) {
+	s = strings.TrimSpace(s)
+
+	if strings.HasPrefix(s, "$") {
+		money, err := strconv.ParseFloat(strings.TrimPrefix(s, "$"), 64)
+		if err != nil || money <= 0 {
+			return Budget{}, fmt.Errorf("invalid money budget %q", s)
+		}
+		return Budget{Money: money}, nil
+	}
+
+	elements, err := strconv.Atoi(s)
+	if err != nil || elements <= 0 {
+		return Budget{}, fmt.Errorf("invalid element budget %q", s)
+	}
+
+	return Budget{Elements: elements}, nil
+}
+
+// maxElements returns the number of elements the budget allows, 0 if it is unlimited.
+func (b Budget) maxElements(pricePerElement float64) int {
+	elements := b.Elements
+	if b.Money > 0 && pricePerElement > 0 {
+		if money := int(b.Money / pricePerElement); elements == 0 || money < elements {
+			elements = money
+		}
+	}
+
+	return elements
+}
+
+func (b Budget) fits(p FetchPlan) bool {
+	return (b.Elements == 0 || p.Elements <= b.Elements) && (b.Money == 0 || p.Cost <= b.Money)
+}
+
+// PlanFetch estimates the fetch of the job.
+func PlanFetch(job FetchJob, pricePerElement float64) (FetchPlan, error) {
+	return planFetch(job, pricePerElement, Budget{})
+}
+
+// planFetch estimates the fetch of the job. Once the origins are known to exceed the budget, they aren't counted
+// further, so the plan of a job that doesn't fit the budget only tells that.
+func planFetch(job FetchJob, pricePerElement float64, budget Budget) (FetchPlan, error) {
+	if len(job.Destinations) == 0 {
+		return FetchPlan{}, errors.New("no destinations")
+	}
+
+	sweep, err := job.sweep()
+	if err != nil {
+		return FetchPlan{}, errors.Wrap(err, "invalid sweep")
+	}
+
+	var maxOrigins int
+	if maxElements := budget.maxElements(pricePerElement); maxElements > 0 {
+		maxOrigins = maxElements/(len(job.Destinations)*len(sweep)) + 1
+	}
+
+	origins, err := job.gridSize(maxOrigins)
+	if err != nil {
+		return FetchPlan{}, errors.Wrap(err, "failed to get src points")
+	}
+
+	elements := origins * len(job.Destinations) * len(sweep)
+
+	requests := countBatches(origins, len(job.Destinations))
+	if job.Direction == DirectionOutbound {
+		requests = countBatches(len(job.Destinations), origins)
+	}
+
+	return FetchPlan{
+		StepMeters:   job.StepMeters,
+		Origins:      origins,
+		Destinations: len(job.Destinations),
+		Elements:     elements,
+		Requests:     requests * len(sweep),
+		Cost:         float64(elements) * pricePerElement,
+	}, nil
+}
+
+// PlanFetchWithinBudget finds the finest step whose fetch of the job area fits the budget.
+func PlanFetchWithinBudget(job FetchJob, budget Budget, pricePerElement float64) (FetchPlan, error) {
+	// a step spanning the whole area yields a single origin
+	job.StepMeters = int(math.Ceil(distanceMeters(job.AreaStart, job.AreaEnd))) + minStepMeters
+
+	plan, err := planFetch(job, pricePerElement, budget)
+	if err != nil {
+		return FetchPlan{}, err
+	}
+	if !budget.fits(plan) {
+		return FetchPlan{}, fmt.Errorf("even a single origin doesn't fit the budget: %d elements, $%.2f", plan.Elements, plan.Cost)
+	}
+
+	// the number of elements decreases as the step grows, so binary search the smallest fitting step
+	lo, hi := minStepMeters, job.StepMeters
+	for lo < hi {
+		job.StepMeters = (lo + hi) / 2
+
+		p, err := planFetch(job, pricePerElement, budget)
+		if err != nil {
+			return FetchPlan{}, err
+		}
+
+		if budget.fits(p) {
+			hi, plan = job.StepMeters, p
+		} else {
+			lo = job.StepMeters + 1
+		}
+	}
+
+	return plan, nil
+}
@@ -0,0 +1,176 @@
+package app
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"github.com/golang/geo/s2"
+	"github.com/pkg/errors"
+	"googlemaps.github.io/maps"
+	"io"
+	"os"
+	"strings"
+)
+
+// Geocoder resolves addresses and place names to points.
+type Geocoder interface {
+	// Geocode returns the matches of the address, the best first. No matches is not an error.
+	Geocode(ctx context.Context, address string) ([]GeocodedPlace, error)
+}
+
+// GeocodedPlace is a match of a geocoded address.
+type GeocodedPlace struct {
+	// Query is the geocoded address as it was written.
+	Query string `yaml:"query"`
+	// Address is the address of the match.
+	Address string `yaml:"address"`
+	// Point is the location of the match, "lat,lng".
+	Point string `yaml:"point"`
+}
+
+// GoogleGeocoder is a Geocoder backed by the Google Geocoding API.
+type GoogleGeocoder struct {
+	client   *maps.Client
+	language string
+}
+
+func NewGoogleGeocoder(apiKey, language string, options ...maps.ClientOption) (*GoogleGeocoder, error) {
+	client, err := maps.NewClient(append([]maps.ClientOption{maps.WithAPIKey(apiKey)}, options...)...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create client")
+	}
+
+	return &GoogleGeocoder{client: client, language: language}, nil
+}
+
+func (g *GoogleGeocoder) Geocode(ctx context.Context, address string) ([]GeocodedPlace, error) {
+	results, err := g.client.Geocode(ctx, &maps.GeocodingRequest{Address: address, Language: g.language})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to process request")
+	}
+
+	var places []GeocodedPlace
+	for _, r := range results {
+		ll := s2.LatLngFromDegrees(r.Geometry.Location.Lat, r.Geometry.Location.Lng)
+		places = append(places, GeocodedPlace{Query: address, Address: r.FormattedAddress, Point: latLonToString(ll)})
+	}
+
+	return places, nil
+}
+
+// Gazetteer is a Geocoder looking up place names in a local list.
+// Names match regardless of case and runs of spaces.
+type Gazetteer struct {
+	places map[string]GeocodedPlace
+}
+
+// LoadGazetteer reads a gazetteer from a CSV file with the name, latitude and longitude columns.
+// A header row and lines starting with # are skipped. Coordinates are in any notation of ParsePoint.
+func LoadGazetteer(path string) (*Gazetteer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to open gazetteer %q", path))
+	}
+	defer file.Close()
+
+	r := csv.NewReader(file)
+	r.Comment = '#'
+	r.FieldsPerRecord = 3
+	r.TrimLeadingSpace = true
+	r.LazyQuotes = true
+
+	g := &Gazetteer{places: make(map[string]GeocodedPlace)}
+	for row := 0; ; row++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("failed to read gazetteer %q", path))
+		}
+
+		ll, err := ParsePoint(record[1] + "," + record[2])
+		if err != nil {
+			if row == 0 {
+				// header
+				continue
+			}
+			return nil, errors.Wrap(err, fmt.Sprintf("gazetteer %q, row %d", path, row+1))
+		}
+
+		g.places[gazetteerKey(record[0])] = GeocodedPlace{Address: record[0], Point: latLonToString(ll)}
+	}
+
+	return g, nil
+}
+
+func (g *Gazetteer) Geocode(ctx context.Context, address string) ([]GeocodedPlace, error) {
+	place, ok := g.places[gazetteerKey(address)]
+	if !ok {
+		return nil, nil
+	}
+
+	place.Query = address
+	return []GeocodedPlace{place}, nil
+}
+
+func gazetteerKey(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// PointResolver parses points and geocodes the addresses that aren't points, see ParsePoint.
+type PointResolver struct {
+	// Geocoder, if nil, makes addresses errors unless they are in Places.
+	Geocoder Geocoder
+	// Places are the addresses geocoded before, they aren't geocoded again.
+	// Resolve appends the addresses it geocodes.
+	Places []GeocodedPlace
+	// Confirm, if set, is called with every geocoded address and the number of its matches.
+	Confirm func(place GeocodedPlace, matches int)
+}
+
+// Resolve returns the point of s, geocoding it if it isn't a point. The best match of the geocoder is taken.
+// A geohash without the prefix is taken only if it isn't a known place or an address the geocoder matches.
+func (r *PointResolver) Resolve(ctx context.Context, s string) (s2.LatLng, error) {
+	ll, parseErr := parsePoint(s, false)
+	if parseErr == nil {
+		return ll, nil
+	}
+
+	for _, place := range r.Places {
+		if place.Query == s {
+			return ParsePoint(place.Point)
+		}
+	}
+
+	if r.Geocoder == nil {
+		if isBareGeohash(strings.TrimSpace(s)) {
+			return ParsePoint(s)
+		}
+		return ll, errors.Wrap(parseErr, "no geocoder to resolve addresses")
+	}
+
+	places, err := r.Geocoder.Geocode(ctx, s)
+	if err != nil {
+		return ll, errors.Wrap(err, fmt.Sprintf("failed to geocode %q", s))
+	}
+	if len(places) == 0 {
+		if isBareGeohash(strings.TrimSpace(s)) {
+			return ParsePoint(s)
+		}
+		return ll, errors.Wrap(parseErr, "no match of the address")
+	}
+
+	place := places[0]
+	ll, err = ParsePoint(place.Point)
+	if err != nil {
+		return ll, errors.Wrap(err, fmt.Sprintf("invalid match of %q", s))
+	}
+
+	r.Places = append(r.Places, place)
+	if r.Confirm != nil {
+		r.Confirm(place, len(places))
+	}
+
+	return ll, nil
+}
@@ -0,0 +1,118 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/geo/s2"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"googlemaps.github.io/maps"
+	"strings"
+)
+
+// GoogleProvider is a TravelTimeProvider backed by the Google Distance Matrix API.
+// Concurrent requests take separate clients, so every fetch worker is rate limited on its own.
+type GoogleProvider struct {
+	clients chan *maps.Client
+}
+
+func NewGoogleProvider(apiKey string, options ...maps.ClientOption) (*GoogleProvider, error) {
+	p := &GoogleProvider{clients: make(chan *maps.Client, workers)}
+	for i := 0; i < workers; i++ {
+		client, err := maps.NewClient(append([]maps.ClientOption{maps.WithAPIKey(apiKey)}, options...)...)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create client")
+		}
+		p.clients <- client
+	}
+
+	return p, nil
+}
+
+// ValidateOptions checks the options for the Distance Matrix API, see Options.Validate.
+func (p *GoogleProvider) ValidateOptions(opts Options) error {
+	return opts.Validate()
+}
+
+func (p *GoogleProvider) TravelTimes(ctx context.Context, origins, destinations []s2.LatLng, opts Options) ([][]TravelTime, error) {
+	client := <-p.clients
+	defer func() { p.clients <- client }()
+
+	r := &maps.DistanceMatrixRequest{}
+
+	if err := opts.Apply(r); err != nil {
+		return nil, &ProviderError{Class: ErrorPermanent, Err: err}
+	}
+
+	for _, ll := range origins {
+		r.Origins = append(r.Origins, latLonToString(ll))
+	}
+	for _, ll := range destinations {
+		r.Destinations = append(r.Destinations, latLonToString(ll))
+	}
+
+	resp, err := client.DistanceMatrix(ctx, r)
+	if err != nil {
+		if status, ok := apiStatus(err); ok {
+			err = &ProviderError{Class: statusClasses[status], Err: err}
+		}
+		return nil, errors.Wrap(err, "failed to process request")
+	}
+
+	if len(origins) != len(resp.Rows) {
+		err := fmt.Errorf("len(origins) != len(resp.Rows): %d != %d ", len(origins), len(resp.Rows))
+		return nil, &ProviderError{Class: ErrorTransient, Err: err}
+	}
+
+	matrix := make([][]TravelTime, len(resp.Rows))
+	for i, row := range resp.Rows {
+		if len(destinations) != len(row.Elements) {
+			// the row is left empty and its elements fail, the other rows are still valid
+			glog.Warningf("len(destinations) != len(row.Elements): %d != %d ", len(destinations), len(row.Elements))
+			continue
+		}
+
+		matrix[i] = make([]TravelTime, len(row.Elements))
+		for j, element := range row.Elements {
+			duration := element.Duration
+			if element.DurationInTraffic > 0 {
+				duration = element.DurationInTraffic
+			}
+
+			matrix[i][j] = TravelTime{
+				Status:            element.Status,
+				Duration:          duration,
+				BaseDuration:      element.Duration,
+				DurationInTraffic: element.DurationInTraffic,
+				Distance:          element.Distance.Meters,
+			}
+			if i < len(resp.OriginAddresses) {
+				matrix[i][j].OriginAddress = resp.OriginAddresses[i]
+			}
+			if j < len(resp.DestinationAddresses) {
+				matrix[i][j].DestinationAddress = resp.DestinationAddresses[j]
+			}
+		}
+	}
+
+	return matrix, nil
+}
+
+// apiStatus returns the request status of an error the maps client returned for a response, "maps: STATUS - message".
+// Errors of other kinds, e.g. network ones, have no status.
+func apiStatus(err error) (string, bool) {
+	msg := err.Error()
+	if !strings.HasPrefix(msg, "maps: ") {
+		return "", false
+	}
+
+	status := strings.TrimPrefix(msg, "maps: ")
+	if i := strings.Index(status, " - "); i >= 0 {
+		status = status[:i]
+	}
+	if status == "" || strings.TrimFunc(status, func(r rune) bool { return r >= 'A' && r <= 'Z' || r == '_' }) != "" {
+		return "", false
+	}
+
+	return status, true
+}
@@ -0,0 +1,632 @@
+package app
+
+import (
+	"fmt"
+	"github.com/golang/geo/s1"
+	"github.com/golang/geo/s2"
+	"math"
+)
+
+// sqrt3 relates the spacing of hexagons to their size.
+const sqrt3 = 1.7320508075688772
+
+type Grid string
+
+const (
+	// GridSquare samples the area in rows of rectangles with equal angular steps.
+	GridSquare Grid = "square"
+	// GridHex samples the area with hexagons spaced the step apart, so that neighbours are equally far in all directions.
+	GridHex Grid = "hex"
+	// GridS2 samples the area with the S2 cells covering it, so cells have near-equal area and stable IDs across runs.
+	GridS2 Grid = "s2"
+)
+
+func ParseGrid(s string) (Grid, error) {
+	switch g := Grid(s); g {
+	case GridSquare, GridHex, GridS2:
+		return g, nil
+	default:
+		return "", fmt.Errorf("unknown grid %q", s)
+	}
+}
+
+// cell is a sampled region of the area with its center used as the origin.
+type cell interface {
+	center() s2.LatLng
+	// bounds returns the north-west and south-east corners of the cell bounding rectangle.
+	bounds() (a, c s2.LatLng)
+	// vertices returns the outline of the cell, nil if it is the bounding rectangle.
+	vertices() []s2.LatLng
+	// id returns the stable ID of the cell, empty if the cell has none.
+	id() string
+	// size returns the side of the cell.
+	size() s1.Angle
+	// neighbours returns the centers of the cells of the same size sharing an edge with the cell.
+	neighbours() []s2.LatLng
+	// subdivide returns the children of the cell, they cover it exactly.
+	subdivide() []cell
+}
+
+// cells returns the cells sampled in the job area.
+func (job FetchJob) cells() ([]cell, error) {
+	cells, err := job.gridCells()
+	if err != nil {
+		return nil, err
+	}
+
+	return job.inArea(cells), nil
+}
+
+// inArea returns the cells centered in the job area polygon, all of them if the job has none.
+func (job FetchJob) inArea(cells []cell) []cell {
+	if job.Area == nil {
+		return cells
+	}
+
+	var inside []cell
+	for _, c := range cells {
+		if job.Area.Contains(c.center()) {
+			inside = append(inside, c)
+		}
+	}
+
+	return inside
+}
+
+// gridCells returns the cells of the grid covering the job area rectangle.
+func (job FetchJob) gridCells() ([]cell, error) {
+	if job.Grid == GridS2 {
+		level, err := job.s2Level()
+		if err != nil {
+			return nil, err
+		}
+
+		covering := getS2Covering(job.AreaStart, job.AreaEnd, level)
+		cells := make([]cell, len(covering))
+		for i, id := range covering {
+			cells[i] = s2Cell(id)
+		}
+
+		return cells, nil
+	}
+
+	if job.Grid == GridHex {
+		origins, stepLat, stepLon, err := getHexGrid(job.Destinations[0], job.AreaStart, job.AreaEnd, job.StepMeters)
+		if err != nil {
+			return nil, err
+		}
+
+		cells := make([]cell, len(origins))
+		for i, origin := range origins {
+			cells[i] = hexCell{c: origin, stepLat: stepLat, stepLon: stepLon}
+		}
+
+		return cells, nil
+	}
+
+	origins, stepLat, stepLon, err := getGrid(job.Destinations[0], job.AreaStart, job.AreaEnd, job.StepMeters)
+	if err != nil {
+		return nil, err
+	}
+
+	cells := make([]cell, len(origins))
+	for i, origin := range origins {
+		cells[i] = squareCell{c: origin, stepLat: stepLat, stepLon: stepLon}
+	}
+
+	return cells, nil
+}
+
+// gridSize returns the number of cells sampled in the job area, without allocating them.
+// If limit is positive, counting cells inside the area polygon stops once there are more than limit of them.
+func (job FetchJob) gridSize(limit int) (int, error) {
+	if job.Area != nil {
+		// only cells inside the polygon are fetched, so they have to be tested one by one
+		var size int
+		err := job.visitGrid(func(center s2.LatLng) bool {
+			if job.Area.Contains(center) {
+				size++
+			}
+			return limit <= 0 || size <= limit
+		})
+		return size, err
+	}
+
+	if job.Grid == GridS2 {
+		level, err := job.s2Level()
+		if err != nil {
+			return 0, err
+		}
+
+		rect := s2.RectFromLatLng(job.AreaStart).AddPoint(job.AreaEnd)
+		var size int
+		for face := 0; face < 6; face++ {
+			size += countS2Cells(rect, s2.CellIDFromFace(face), level)
+		}
+		return size, nil
+	}
+	if job.Grid == GridHex {
+		return getHexGridSize(job.Destinations[0], job.AreaStart, job.AreaEnd, job.StepMeters)
+	}
+
+	return getGridSize(job.Destinations[0], job.AreaStart, job.AreaEnd, job.StepMeters)
+}
+
+// visitGrid calls visit with the center of every cell of the grid covering the job area rectangle,
+// without allocating the cells, until visit returns false.
+func (job FetchJob) visitGrid(visit func(center s2.LatLng) bool) error {
+	if job.Grid == GridS2 {
+		level, err := job.s2Level()
+		if err != nil {
+			return err
+		}
+
+		rect := s2.RectFromLatLng(job.AreaStart).AddPoint(job.AreaEnd)
+		for face := 0; face < 6; face++ {
+			if !visitS2Cells(rect, s2.CellIDFromFace(face), level, visit) {
+				break
+			}
+		}
+		return nil
+	}
+
+	if job.StepMeters <= 0 {
+		return fmt.Errorf("invalid step %d", job.StepMeters)
+	}
+
+	stepLat, stepLon := getSteps(job.Destinations[0], job.StepMeters)
+	rectStart, rectEnd := sortRectCorners(job.AreaStart, job.AreaEnd)
+
+	rowStep := stepLat
+	if job.Grid == GridHex {
+		rowStep = stepLat * sqrt3 / 2
+	}
+
+	row := 0
+	for lat := rectStart.Lat; lat < rectEnd.Lat; lat += rowStep {
+		lon := rectStart.Lng
+		if job.Grid == GridHex && row%2 == 1 {
+			lon += stepLon / 2
+		}
+		for ; lon < rectEnd.Lng; lon += stepLon {
+			if !visit(s2.LatLng{Lat: lat, Lng: lon}) {
+				return nil
+			}
+		}
+		row++
+	}
+
+	return nil
+}
+
+// countS2Cells returns the number of cells of the level below id intersecting the rectangle.
+// Only the cells crossed by the rectangle edges are descended into.
+func countS2Cells(rect s2.Rect, id s2.CellID, level int) int {
+	cell := s2.CellFromCellID(id)
+	if !rect.IntersectsCell(cell) {
+		return 0
+	}
+	if id.Level() == level {
+		return 1
+	}
+	if rect.ContainsCell(cell) {
+		return 1 << uint(2*(level-id.Level()))
+	}
+
+	var size int
+	for child := id.ChildBegin(); child != id.ChildEnd(); child = child.Next() {
+		size += countS2Cells(rect, child, level)
+	}
+
+	return size
+}
+
+// visitS2Cells calls visit with the center of every cell of the level below id intersecting the rectangle.
+// It returns false once visit does.
+func visitS2Cells(rect s2.Rect, id s2.CellID, level int, visit func(center s2.LatLng) bool) bool {
+	if !rect.IntersectsCell(s2.CellFromCellID(id)) {
+		return true
+	}
+	if id.Level() == level {
+		return visit(id.LatLng())
+	}
+
+	for child := id.ChildBegin(); child != id.ChildEnd(); child = child.Next() {
+		if !visitS2Cells(rect, child, level, visit) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (job FetchJob) s2Level() (int, error) {
+	if job.S2Level < 0 || job.S2Level > 30 {
+		return 0, fmt.Errorf("invalid S2 level %d", job.S2Level)
+	}
+	if job.S2Level > 0 {
+		return job.S2Level, nil
+	}
+
+	if job.StepMeters <= 0 {
+		return 0, fmt.Errorf("invalid step %d", job.StepMeters)
+	}
+
+	return s2.AvgEdgeMetric.ClosestLevel(float64(job.StepMeters) / earthRadius), nil
+}
+
+// getS2Covering returns the cells of the level covering the rectangle.
+func getS2Covering(areaStart, areaEnd s2.LatLng, level int) s2.CellUnion {
+	coverer := s2.RegionCoverer{MinLevel: level, MaxLevel: level, LevelMod: 1, MaxCells: math.MaxInt32}
+	return coverer.Covering(s2.RectFromLatLng(areaStart).AddPoint(areaEnd))
+}
+
+// squareCell is a rectangle of the square grid.
+type squareCell struct {
+	c                s2.LatLng
+	stepLat, stepLon s1.Angle
+}
+
+func (c squareCell) center() s2.LatLng {
+	return c.c
+}
+
+func (c squareCell) bounds() (a, b s2.LatLng) {
+	return getOriginBounds(c.c, c.stepLat, c.stepLon)
+}
+
+func (c squareCell) vertices() []s2.LatLng {
+	return nil
+}
+
+func (c squareCell) id() string {
+	return ""
+}
+
+func (c squareCell) size() s1.Angle {
+	return c.stepLat
+}
+
+func (c squareCell) neighbours() []s2.LatLng {
+	return []s2.LatLng{
+		{Lat: c.c.Lat + c.stepLat, Lng: c.c.Lng},
+		{Lat: c.c.Lat - c.stepLat, Lng: c.c.Lng},
+		{Lat: c.c.Lat, Lng: c.c.Lng + c.stepLon},
+		{Lat: c.c.Lat, Lng: c.c.Lng - c.stepLon},
+	}
+}
+
+// subdivide returns the four quadrants of the cell.
+func (c squareCell) subdivide() []cell {
+	var children []cell
+	for _, dLat := range []s1.Angle{-c.stepLat / 4, c.stepLat / 4} {
+		for _, dLng := range []s1.Angle{-c.stepLon / 4, c.stepLon / 4} {
+			children = append(children, squareCell{
+				c:       s2.LatLng{Lat: c.c.Lat + dLat, Lng: c.c.Lng + dLng},
+				stepLat: c.stepLat / 2,
+				stepLon: c.stepLon / 2,
+			})
+		}
+	}
+
+	return children
+}
+
+// getHexGrid returns the centers of pointy-top hexagons spaced stepMeters apart in the area
+// and the angular steps between the centers of a row. Odd rows are shifted by half a step.
+func getHexGrid(dest, areaStart, areaEnd s2.LatLng, stepMeters int) (origins []s2.LatLng, stepLat, stepLon s1.Angle, err error) {
+	if stepMeters <= 0 {
+		return nil, 0, 0, fmt.Errorf("invalid step %d", stepMeters)
+	}
+
+	stepLat, stepLon = getSteps(dest, stepMeters)
+	rectStart, rectEnd := sortRectCorners(areaStart, areaEnd)
+
+	row := 0
+	for lat := rectStart.Lat; lat < rectEnd.Lat; lat += stepLat * sqrt3 / 2 {
+		lon := rectStart.Lng
+		if row%2 == 1 {
+			lon += stepLon / 2
+		}
+		for ; lon < rectEnd.Lng; lon += stepLon {
+			origins = append(origins, s2.LatLng{Lat: lat, Lng: lon})
+		}
+		row++
+	}
+
+	return origins, stepLat, stepLon, nil
+}
+
+// getHexGridSize returns the number of origins getHexGrid yields, without allocating them.
+func getHexGridSize(dest, areaStart, areaEnd s2.LatLng, stepMeters int) (int, error) {
+	if stepMeters <= 0 {
+		return 0, fmt.Errorf("invalid step %d", stepMeters)
+	}
+
+	stepLat, stepLon := getSteps(dest, stepMeters)
+	rectStart, rectEnd := sortRectCorners(areaStart, areaEnd)
+
+	// odd rows are shifted by half a step
+	var columns [2]int
+	for i := range columns {
+		for lon := rectStart.Lng + s1.Angle(i)*stepLon/2; lon < rectEnd.Lng; lon += stepLon {
+			columns[i]++
+		}
+	}
+
+	var size, row int
+	for lat := rectStart.Lat; lat < rectEnd.Lat; lat += stepLat * sqrt3 / 2 {
+		size += columns[row%2]
+		row++
+	}
+
+	return size, nil
+}
+
+// hexCell is a pointy-top hexagon of the hex grid; stepLat and stepLon are the distance between
+// the centers of neighbouring hexagons expressed in latitude and longitude.
+// Hexagons of a subdivided cell are clipped to it, so they don't stick out of it.
+type hexCell struct {
+	c                s2.LatLng
+	stepLat, stepLon s1.Angle
+	// outline is the hexagon clipped to its parent, nil if the hexagon is whole.
+	outline []s2.LatLng
+	// parent is the subdivided cell, nil for cells of the grid.
+	parent *hexCell
+}
+
+// center returns the center of the hexagon, or the centroid of its clipped outline.
+func (c hexCell) center() s2.LatLng {
+	if c.outline == nil {
+		return c.c
+	}
+
+	return polygonCentroid(c.outline)
+}
+
+func (c hexCell) bounds() (a, b s2.LatLng) {
+	if c.outline == nil {
+		return getOriginBounds(c.c, 2*c.stepLat/sqrt3, c.stepLon)
+	}
+
+	rect := s2.EmptyRect()
+	for _, v := range c.outline {
+		rect = rect.AddPoint(v)
+	}
+
+	return s2.LatLng{Lat: rect.Hi().Lat, Lng: rect.Lo().Lng}, s2.LatLng{Lat: rect.Lo().Lat, Lng: rect.Hi().Lng}
+}
+
+func (c hexCell) vertices() []s2.LatLng {
+	if c.outline != nil {
+		return c.outline
+	}
+
+	return c.hexagon()
+}
+
+// hexagon returns the vertices of the whole hexagon, counter-clockwise.
+func (c hexCell) hexagon() []s2.LatLng {
+	vertices := make([]s2.LatLng, 6)
+	for k := range vertices {
+		angle := math.Pi/6 + float64(k)*math.Pi/3
+		vertices[k] = s2.LatLng{
+			Lat: c.c.Lat + c.stepLat/sqrt3*s1.Angle(math.Sin(angle)),
+			Lng: c.c.Lng + c.stepLon/sqrt3*s1.Angle(math.Cos(angle)),
+		}
+	}
+
+	return vertices
+}
+
+func (c hexCell) id() string {
+	return ""
+}
+
+func (c hexCell) size() s1.Angle {
+	return c.stepLat
+}
+
+// neighbours returns the centers of the hexagons of the same step around the cell clipped to its parent,
+// and of the rest of its hexagon clipped to the neighbouring parents if it was clipped.
+func (c hexCell) neighbours() []s2.LatLng {
+	if c.parent == nil {
+		return hexNeighbours(c.c, c.stepLat, c.stepLon)
+	}
+
+	var centers []s2.LatLng
+	for _, n := range hexNeighbours(c.c, c.stepLat, c.stepLon) {
+		if child, ok := c.parent.child(n); ok {
+			centers = append(centers, child.center())
+		}
+	}
+
+	if c.outline != nil {
+		for _, p := range c.parent.siblings() {
+			if child, ok := p.child(c.c); ok {
+				centers = append(centers, child.center())
+			}
+		}
+	}
+
+	return centers
+}
+
+// siblings returns the cells of the same step around the cell within its parent.
+func (c hexCell) siblings() []hexCell {
+	var siblings []hexCell
+	for _, n := range hexNeighbours(c.c, c.stepLat, c.stepLon) {
+		if c.parent == nil {
+			siblings = append(siblings, hexCell{c: n, stepLat: c.stepLat, stepLon: c.stepLon})
+		} else if sibling, ok := c.parent.child(n); ok {
+			siblings = append(siblings, sibling)
+		}
+	}
+
+	return siblings
+}
+
+func hexNeighbours(c s2.LatLng, stepLat, stepLon s1.Angle) []s2.LatLng {
+	rowStep := stepLat * sqrt3 / 2
+
+	return []s2.LatLng{
+		{Lat: c.Lat, Lng: c.Lng + stepLon},
+		{Lat: c.Lat, Lng: c.Lng - stepLon},
+		{Lat: c.Lat + rowStep, Lng: c.Lng + stepLon/2},
+		{Lat: c.Lat + rowStep, Lng: c.Lng - stepLon/2},
+		{Lat: c.Lat - rowStep, Lng: c.Lng + stepLon/2},
+		{Lat: c.Lat - rowStep, Lng: c.Lng - stepLon/2},
+	}
+}
+
+// subdivide returns the hexagons of half the step at the center of the cell and at the middle of its edges,
+// clipped to the cell. The central one is whole and the others are halves, so together they cover the cell exactly.
+func (c hexCell) subdivide() []cell {
+	var children []cell
+	for _, center := range append([]s2.LatLng{c.c}, hexNeighbours(c.c, c.stepLat/2, c.stepLon/2)...) {
+		if child, ok := c.child(center); ok {
+			children = append(children, child)
+		}
+	}
+
+	return children
+}
+
+// child returns the hexagon of half the step centered at the point clipped to the cell, false if it is outside.
+func (c hexCell) child(center s2.LatLng) (hexCell, bool) {
+	parent := c
+	child := hexCell{c: center, stepLat: c.stepLat / 2, stepLon: c.stepLon / 2, parent: &parent}
+
+	hexagon := child.hexagon()
+	outline := clipPolygon(hexagon, c.vertices())
+	area := polygonArea(outline)
+	if area < polygonArea(hexagon)*1e-6 {
+		return hexCell{}, false
+	}
+	if area < polygonArea(hexagon)*(1-1e-6) {
+		child.outline = outline
+	}
+
+	return child, true
+}
+
+// clipPolygon returns the part of the polygon inside the convex clip polygon, both counter-clockwise,
+// treating latitude and longitude as plane coordinates as the cells do.
+func clipPolygon(polygon, clip []s2.LatLng) []s2.LatLng {
+	// cross is positive if p is to the left of the edge from a to b
+	cross := func(a, b, p s2.LatLng) float64 {
+		return float64((b.Lng-a.Lng)*(p.Lat-a.Lat) - (b.Lat-a.Lat)*(p.Lng-a.Lng))
+	}
+
+	out := polygon
+	for i := range clip {
+		a, b := clip[i], clip[(i+1)%len(clip)]
+
+		in := out
+		out = nil
+		for j := range in {
+			p, q := in[j], in[(j+1)%len(in)]
+			cp, cq := cross(a, b, p), cross(a, b, q)
+			if cp >= 0 {
+				out = append(out, p)
+			}
+			if (cp >= 0) != (cq >= 0) {
+				t := s1.Angle(cp / (cp - cq))
+				out = append(out, s2.LatLng{Lat: p.Lat + (q.Lat-p.Lat)*t, Lng: p.Lng + (q.Lng-p.Lng)*t})
+			}
+		}
+		if len(out) == 0 {
+			return nil
+		}
+	}
+
+	return out
+}
+
+// polygonArea returns the area of the counter-clockwise polygon in squared radians of latitude and longitude.
+func polygonArea(polygon []s2.LatLng) float64 {
+	var area float64
+	for i := range polygon {
+		p, q := polygonEdge(polygon, i)
+		area += float64(p.Lng*q.Lat - q.Lng*p.Lat)
+	}
+
+	return area / 2
+}
+
+// polygonCentroid returns the centroid of the polygon in latitude and longitude.
+func polygonCentroid(polygon []s2.LatLng) s2.LatLng {
+	var lat, lng, area float64
+	for i := range polygon {
+		p, q := polygonEdge(polygon, i)
+		cross := float64(p.Lng*q.Lat - q.Lng*p.Lat)
+		area += cross
+		lat += float64(p.Lat+q.Lat) * cross
+		lng += float64(p.Lng+q.Lng) * cross
+	}
+
+	origin := polygon[0]
+	return s2.LatLng{Lat: origin.Lat + s1.Angle(lat/(3*area)), Lng: origin.Lng + s1.Angle(lng/(3*area))}
+}
+
+// polygonEdge returns the ends of the i-th edge of the polygon relative to its first vertex,
+// so that the sums over edges don't lose precision to the magnitude of the coordinates.
+func polygonEdge(polygon []s2.LatLng, i int) (p, q s2.LatLng) {
+	origin := polygon[0]
+	p, q = polygon[i], polygon[(i+1)%len(polygon)]
+
+	return s2.LatLng{Lat: p.Lat - origin.Lat, Lng: p.Lng - origin.Lng}, s2.LatLng{Lat: q.Lat - origin.Lat, Lng: q.Lng - origin.Lng}
+}
+
+// s2Cell is a cell of the s2 grid.
+type s2Cell s2.CellID
+
+func (c s2Cell) center() s2.LatLng {
+	return s2.CellID(c).LatLng()
+}
+
+func (c s2Cell) bounds() (a, b s2.LatLng) {
+	rect := s2.CellFromCellID(s2.CellID(c)).RectBound()
+	return s2.LatLng{Lat: rect.Hi().Lat, Lng: rect.Lo().Lng}, s2.LatLng{Lat: rect.Lo().Lat, Lng: rect.Hi().Lng}
+}
+
+func (c s2Cell) vertices() []s2.LatLng {
+	cell := s2.CellFromCellID(s2.CellID(c))
+
+	vertices := make([]s2.LatLng, 4)
+	for k := range vertices {
+		vertices[k] = s2.LatLngFromPoint(cell.Vertex(k))
+	}
+
+	return vertices
+}
+
+func (c s2Cell) id() string {
+	return s2.CellID(c).ToToken()
+}
+
+func (c s2Cell) size() s1.Angle {
+	return s1.Angle(s2.AvgEdgeMetric.Value(s2.CellID(c).Level()))
+}
+
+func (c s2Cell) neighbours() []s2.LatLng {
+	var centers []s2.LatLng
+	for _, n := range s2.CellID(c).EdgeNeighbors() {
+		centers = append(centers, n.LatLng())
+	}
+
+	return centers
+}
+
+func (c s2Cell) subdivide() []cell {
+	if s2.CellID(c).IsLeaf() {
+		return nil
+	}
+
+	var children []cell
+	for _, child := range s2.CellID(c).Children() {
+		children = append(children, s2Cell(child))
+	}
+
+	return children
+}
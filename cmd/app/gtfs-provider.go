@@ -0,0 +1,261 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/geo/s2"
+	"github.com/pkg/errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	StatusZeroResults = "ZERO_RESULTS"
+
+	unreachable = math.MaxInt32
+)
+
+// WalkingModel describes walking to and from stops and between them.
+type WalkingModel struct {
+	// Speed is the walking speed in meters per second.
+	Speed float64
+	// MaxAccessDistance is the longest walk in meters from an origin to a stop or from a stop to a destination.
+	MaxAccessDistance float64
+	// MaxTransferDistance is the longest walk in meters between two stops.
+	MaxTransferDistance float64
+}
+
+var DefaultWalkingModel = WalkingModel{
+	Speed:               1.3,
+	MaxAccessDistance:   1000,
+	MaxTransferDistance: 300,
+}
+
+// duration returns the walking time between a and b in seconds.
+func (w WalkingModel) duration(a, b s2.LatLng) int {
+	return int(math.Ceil(distanceMeters(a, b) / w.Speed))
+}
+
+// GtfsProvider is a TravelTimeProvider that routes over a local GTFS feed with RAPTOR.
+// It answers departure time queries for transit; trips running past midnight
+// are only considered on the service day they start on.
+type GtfsProvider struct {
+	feed         *gtfsFeed
+	walking      WalkingModel
+	maxTransfers int
+	stops        *stopIndex
+
+	mu sync.Mutex
+	// activeServices caches the services running on a date, formatted as gtfsDateLayout.
+	activeServices map[string][]bool
+}
+
+func NewGtfsProvider(feedFile string, walking WalkingModel, maxTransfers int) (*GtfsProvider, error) {
+	if walking.Speed <= 0 {
+		return nil, fmt.Errorf("invalid walking speed %v", walking.Speed)
+	}
+	if maxTransfers < 0 {
+		return nil, fmt.Errorf("invalid max transfers %d", maxTransfers)
+	}
+
+	feed, err := loadGtfsFeed(feedFile, walking)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load GTFS feed")
+	}
+
+	return &GtfsProvider{
+		feed:           feed,
+		walking:        walking,
+		maxTransfers:   maxTransfers,
+		stops:          newStopIndex(feed.stops, walking.MaxAccessDistance),
+		activeServices: make(map[string][]bool),
+	}, nil
+}
+
+// ValidateOptions checks that the options ask for transit departing at a time, the only fetch the feed answers.
+func (p *GtfsProvider) ValidateOptions(opts Options) error {
+	if opts.Mode != "" && opts.Mode != "transit" {
+		return fmt.Errorf("GTFS provider supports transit mode only, got %q", opts.Mode)
+	}
+	if opts.ArrivalTime != (time.Time{}) {
+		return errors.New("GTFS provider doesn't support arrival time, use departure time")
+	}
+
+	return nil
+}
+
+func (p *GtfsProvider) TravelTimes(ctx context.Context, origins, destinations []s2.LatLng, opts Options) ([][]TravelTime, error) {
+	if err := p.ValidateOptions(opts); err != nil {
+		return nil, err
+	}
+
+	departure := opts.DepartureTime
+	if departure == (time.Time{}) {
+		departure = time.Now()
+	}
+	departure = departure.In(p.feed.location)
+
+	year, month, day := departure.Date()
+	midnight := time.Date(year, month, day, 0, 0, 0, 0, p.feed.location)
+	startTime := int(departure.Sub(midnight) / time.Second)
+	active := p.getActiveServices(departure)
+
+	egress := make([][]footpath, len(destinations))
+	for j, dest := range destinations {
+		for _, stop := range p.stops.nearby(dest, p.walking.MaxAccessDistance) {
+			egress[j] = append(egress[j], footpath{stop, p.walking.duration(p.feed.stops[stop].ll, dest)})
+		}
+	}
+
+	matrix := make([][]TravelTime, len(origins))
+	for i, origin := range origins {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		var access []footpath
+		for _, stop := range p.stops.nearby(origin, p.walking.MaxAccessDistance) {
+			access = append(access, footpath{stop, p.walking.duration(origin, p.feed.stops[stop].ll)})
+		}
+
+		arrivals := p.route(startTime, access, active)
+
+		matrix[i] = make([]TravelTime, len(destinations))
+		for j, dest := range destinations {
+			best := unreachable
+			if distanceMeters(origin, dest) <= p.walking.MaxAccessDistance {
+				best = startTime + p.walking.duration(origin, dest)
+			}
+			for _, e := range egress[j] {
+				if arrivals[e.to] != unreachable && arrivals[e.to]+e.duration < best {
+					best = arrivals[e.to] + e.duration
+				}
+			}
+
+			if best == unreachable {
+				matrix[i][j] = TravelTime{Status: StatusZeroResults}
+				continue
+			}
+
+			duration := time.Duration(best-startTime) * time.Second
+			matrix[i][j] = TravelTime{
+				Status:       StatusOK,
+				Duration:     duration,
+				BaseDuration: duration,
+			}
+		}
+	}
+
+	return matrix, nil
+}
+
+func (p *GtfsProvider) getActiveServices(date time.Time) []bool {
+	key := date.Format(gtfsDateLayout)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	active, ok := p.activeServices[key]
+	if !ok {
+		active = make([]bool, len(p.feed.services))
+		for i := range p.feed.services {
+			active[i] = p.feed.services[i].isActive(key, date.Weekday())
+		}
+		p.activeServices[key] = active
+	}
+
+	return active
+}
+
+// route runs a RAPTOR search and returns the earliest arrival time at every stop.
+// Times are seconds since midnight of the service day.
+func (p *GtfsProvider) route(startTime int, access []footpath, active []bool) []int {
+	feed := p.feed
+
+	best := make([]int, len(feed.stops))
+	previous := make([]int, len(feed.stops))
+	for i := range best {
+		best[i] = unreachable
+	}
+
+	marked := make(map[int]bool)
+	for _, a := range access {
+		if startTime+a.duration < best[a.to] {
+			best[a.to] = startTime + a.duration
+			marked[a.to] = true
+		}
+	}
+	p.relaxFootpaths(best, marked)
+
+	for round := 0; round <= p.maxTransfers && len(marked) > 0; round++ {
+		copy(previous, best)
+
+		// collect the patterns serving marked stops, starting from the earliest marked position
+		queue := make(map[int]int)
+		for stop := range marked {
+			for _, pp := range feed.stopPatterns[stop] {
+				if position, ok := queue[pp.pattern]; !ok || pp.position < position {
+					queue[pp.pattern] = pp.position
+				}
+			}
+		}
+		marked = make(map[int]bool)
+
+		for patternIdx, start := range queue {
+			pattern := &feed.patterns[patternIdx]
+			var trip *gtfsTrip
+
+			for position := start; position < len(pattern.stops); position++ {
+				stop := pattern.stops[position]
+
+				if trip != nil && trip.arrivals[position] < best[stop] {
+					best[stop] = trip.arrivals[position]
+					marked[stop] = true
+				}
+
+				if previous[stop] != unreachable && (trip == nil || previous[stop] <= trip.departures[position]) {
+					if t := earliestTrip(pattern, position, previous[stop], active); t != nil {
+						trip = t
+					}
+				}
+			}
+		}
+
+		p.relaxFootpaths(best, marked)
+	}
+
+	return best
+}
+
+func (p *GtfsProvider) relaxFootpaths(best []int, marked map[int]bool) {
+	var walked []int
+	for stop := range marked {
+		for _, f := range p.feed.footpaths[stop] {
+			if best[stop]+f.duration < best[f.to] {
+				best[f.to] = best[stop] + f.duration
+				walked = append(walked, f.to)
+			}
+		}
+	}
+
+	for _, stop := range walked {
+		marked[stop] = true
+	}
+}
+
+// earliestTrip returns the first active trip of the pattern departing from position at or after t.
+// Trips of a pattern are assumed not to overtake each other.
+func earliestTrip(pattern *gtfsPattern, position, t int, active []bool) *gtfsTrip {
+	trips := pattern.trips
+	i := sort.Search(len(trips), func(i int) bool { return trips[i].departures[position] >= t })
+
+	for ; i < len(trips); i++ {
+		if active[trips[i].service] {
+			return &trips[i]
+		}
+	}
+
+	return nil
+}
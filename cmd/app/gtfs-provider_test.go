@@ -0,0 +1,63 @@
+package app
+
+import (
+	"context"
+	"github.com/golang/geo/s2"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGtfsProviderTravelTimes(t *testing.T) {
+	path := zipTestFeed(t)
+	defer os.Remove(path)
+
+	// stops are 11 km apart, so only the explicit transfer B-B2 connects the routes
+	walking := WalkingModel{Speed: 1, MaxAccessDistance: 100, MaxTransferDistance: 0}
+
+	a := s2.LatLngFromDegrees(0, 0)
+	c := s2.LatLngFromDegrees(0, 0.2)
+	d := s2.LatLngFromDegrees(0, 0.3)
+	nearA := s2.LatLngFromDegrees(0, 0.0005)
+
+	monday := time.Date(2026, 10, 19, 7, 55, 0, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		dest         s2.LatLng
+		departure    time.Time
+		maxTransfers int
+		status       string
+		duration     time.Duration
+	}{
+		{name: "direct trip", dest: c, departure: monday, maxTransfers: 1, status: StatusOK, duration: 25 * time.Minute},
+		{name: "transfer", dest: d, departure: monday, maxTransfers: 1, status: StatusOK, duration: 35 * time.Minute},
+		{name: "no transfers allowed", dest: d, departure: monday, maxTransfers: 0, status: StatusZeroResults},
+		{name: "trip missed", dest: c, departure: monday.Add(10 * time.Minute), maxTransfers: 1, status: StatusZeroResults},
+		{name: "weekend service", dest: c, departure: monday.AddDate(0, 0, 5), maxTransfers: 1, status: StatusOK, duration: 45 * time.Minute},
+		{name: "removed and added dates", dest: c, departure: monday.AddDate(0, 0, 1), maxTransfers: 1, status: StatusOK, duration: 45 * time.Minute},
+		{name: "after the calendar", dest: c, departure: time.Date(2027, 1, 4, 7, 55, 0, 0, time.UTC), maxTransfers: 1, status: StatusZeroResults},
+		{name: "walk only", dest: nearA, departure: monday, maxTransfers: 1, status: StatusOK,
+			duration: time.Duration(walking.duration(a, nearA)) * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider, err := NewGtfsProvider(path, walking, tt.maxTransfers)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			opts := Options{Mode: "transit", DepartureTime: tt.departure}
+			matrix, err := provider.TravelTimes(context.Background(), []s2.LatLng{a}, []s2.LatLng{tt.dest}, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := matrix[0][0]
+			if got.Status != tt.status || got.Duration != tt.duration {
+				t.Errorf("got %s %v, want %s %v", got.Status, got.Duration, tt.status, tt.duration)
+			}
+		})
+	}
+}
@@ -0,0 +1,502 @@
+package app
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"fmt"
+	"github.com/golang/geo/s2"
+	"github.com/pkg/errors"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	gtfsDateLayout = "20060102"
+
+	transferNotPossible = 3
+)
+
+// gtfsFeed is a GTFS feed preprocessed for RAPTOR queries.
+type gtfsFeed struct {
+	location *time.Location
+
+	stops     []gtfsStop
+	stopIndex map[string]int
+
+	services     []gtfsService
+	serviceIndex map[string]int
+
+	patterns []gtfsPattern
+
+	// stopPatterns lists the patterns serving every stop and the position of the stop in them.
+	stopPatterns [][]patternPosition
+	// footpaths lists the transfers available from every stop.
+	footpaths [][]footpath
+}
+
+type gtfsStop struct {
+	id string
+	ll s2.LatLng
+}
+
+type gtfsService struct {
+	weekdays   [7]bool
+	start, end string
+	added      map[string]bool
+	removed    map[string]bool
+}
+
+// gtfsPattern is a RAPTOR route: a set of trips visiting the same sequence of stops.
+type gtfsPattern struct {
+	stops []int
+	// trips are sorted by departure from the first stop.
+	trips []gtfsTrip
+}
+
+type gtfsTrip struct {
+	service int
+	// arrivals and departures are seconds since midnight of the service day, indexed by pattern position.
+	arrivals, departures []int
+}
+
+type patternPosition struct {
+	pattern, position int
+}
+
+type footpath struct {
+	to       int
+	duration int
+}
+
+// loadGtfsFeed reads stops, trips, stop_times, calendar, calendar_dates and transfers from a GTFS zip.
+// Transfers missing from transfers.txt are generated between stops within walking.MaxTransferDistance.
+func loadGtfsFeed(path string, walking WalkingModel) (*gtfsFeed, error) {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to open GTFS feed %q", path))
+	}
+	defer archive.Close()
+
+	files := make(map[string]*zip.File)
+	for _, f := range archive.File {
+		files[f.Name] = f
+	}
+
+	feed := &gtfsFeed{
+		location:     time.Local,
+		stopIndex:    make(map[string]int),
+		serviceIndex: make(map[string]int),
+	}
+
+	steps := []struct {
+		name     string
+		required bool
+		load     func(rows []map[string]string) error
+	}{
+		{"agency.txt", false, feed.loadAgency},
+		{"stops.txt", true, feed.loadStops},
+		{"calendar.txt", false, feed.loadCalendar},
+		{"calendar_dates.txt", false, feed.loadCalendarDates},
+	}
+
+	for _, step := range steps {
+		rows, err := readGtfsFile(files, step.name, step.required)
+		if err != nil {
+			return nil, err
+		}
+		if err := step.load(rows); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("invalid %s", step.name))
+		}
+	}
+
+	trips, err := readGtfsFile(files, "trips.txt", true)
+	if err != nil {
+		return nil, err
+	}
+	stopTimes, err := readGtfsFile(files, "stop_times.txt", true)
+	if err != nil {
+		return nil, err
+	}
+	if err := feed.loadTrips(trips, stopTimes); err != nil {
+		return nil, errors.Wrap(err, "invalid trips")
+	}
+
+	transfers, err := readGtfsFile(files, "transfers.txt", false)
+	if err != nil {
+		return nil, err
+	}
+	if err := feed.loadTransfers(transfers, walking); err != nil {
+		return nil, errors.Wrap(err, "invalid transfers.txt")
+	}
+
+	return feed, nil
+}
+
+func readGtfsFile(files map[string]*zip.File, name string, required bool) ([]map[string]string, error) {
+	f, ok := files[name]
+	if !ok {
+		if required {
+			return nil, fmt.Errorf("GTFS feed has no %s", name)
+		}
+		return nil, nil
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to open %s", name))
+	}
+	defer rc.Close()
+
+	reader := csv.NewReader(rc)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to read %s", name))
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(strings.TrimPrefix(header[i], "\ufeff"))
+	}
+
+	var rows []map[string]string
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("failed to read %s", name))
+		}
+
+		row := make(map[string]string, len(header))
+		for i, v := range record {
+			if i < len(header) {
+				row[header[i]] = strings.TrimSpace(v)
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+func (f *gtfsFeed) loadAgency(rows []map[string]string) error {
+	for _, row := range rows {
+		if row["agency_timezone"] == "" {
+			continue
+		}
+		loc, err := time.LoadLocation(row["agency_timezone"])
+		if err != nil {
+			return errors.Wrap(err, "invalid agency_timezone")
+		}
+		f.location = loc
+		return nil
+	}
+
+	return nil
+}
+
+// loadStops loads the stops with their coordinates. Generic nodes and boarding areas may have none, they take
+// the coordinates of their parent station or platform, or are skipped without one: trips don't stop at them.
+func (f *gtfsFeed) loadStops(rows []map[string]string) error {
+	coords := make(map[string]s2.LatLng, len(rows))
+	var unplaced []map[string]string
+
+	for _, row := range rows {
+		if row["stop_lat"] == "" && row["stop_lon"] == "" && isGtfsPathwayNode(row["location_type"]) {
+			unplaced = append(unplaced, row)
+			continue
+		}
+
+		lat, err := strconv.ParseFloat(row["stop_lat"], 64)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("invalid stop_lat of stop %q", row["stop_id"]))
+		}
+		lon, err := strconv.ParseFloat(row["stop_lon"], 64)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("invalid stop_lon of stop %q", row["stop_id"]))
+		}
+
+		coords[row["stop_id"]] = s2.LatLngFromDegrees(lat, lon)
+		f.addStop(row["stop_id"], coords[row["stop_id"]])
+	}
+
+	for _, row := range unplaced {
+		if ll, ok := coords[row["parent_station"]]; ok {
+			f.addStop(row["stop_id"], ll)
+		}
+	}
+
+	f.stopPatterns = make([][]patternPosition, len(f.stops))
+	f.footpaths = make([][]footpath, len(f.stops))
+
+	return nil
+}
+
+func (f *gtfsFeed) addStop(id string, ll s2.LatLng) {
+	f.stopIndex[id] = len(f.stops)
+	f.stops = append(f.stops, gtfsStop{id: id, ll: ll})
+}
+
+// isGtfsPathwayNode reports whether the location_type is a generic node or a boarding area,
+// the locations whose coordinates are optional.
+func isGtfsPathwayNode(locationType string) bool {
+	return locationType == "3" || locationType == "4"
+}
+
+// service returns the index of the service with the given id, registering it if it is new.
+func (f *gtfsFeed) service(id string) int {
+	i, ok := f.serviceIndex[id]
+	if !ok {
+		i = len(f.services)
+		f.serviceIndex[id] = i
+		f.services = append(f.services, gtfsService{added: map[string]bool{}, removed: map[string]bool{}})
+	}
+
+	return i
+}
+
+func (f *gtfsFeed) loadCalendar(rows []map[string]string) error {
+	days := []string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+
+	for _, row := range rows {
+		s := &f.services[f.service(row["service_id"])]
+		for i, day := range days {
+			s.weekdays[i] = row[day] == "1"
+		}
+		s.start, s.end = row["start_date"], row["end_date"]
+	}
+
+	return nil
+}
+
+func (f *gtfsFeed) loadCalendarDates(rows []map[string]string) error {
+	for _, row := range rows {
+		s := &f.services[f.service(row["service_id"])]
+		switch row["exception_type"] {
+		case "1":
+			s.added[row["date"]] = true
+		case "2":
+			s.removed[row["date"]] = true
+		default:
+			return fmt.Errorf("unknown exception_type %q", row["exception_type"])
+		}
+	}
+
+	return nil
+}
+
+func (f *gtfsFeed) loadTrips(tripRows, stopTimeRows []map[string]string) error {
+	type stopTime struct {
+		sequence           int
+		stop               int
+		arrival, departure int
+	}
+
+	tripServices := make(map[string]int, len(tripRows))
+	for _, row := range tripRows {
+		tripServices[row["trip_id"]] = f.service(row["service_id"])
+	}
+
+	tripStopTimes := make(map[string][]stopTime, len(tripRows))
+	for _, row := range stopTimeRows {
+		stop, ok := f.stopIndex[row["stop_id"]]
+		if !ok {
+			return fmt.Errorf("unknown stop_id %q", row["stop_id"])
+		}
+		sequence, err := strconv.Atoi(row["stop_sequence"])
+		if err != nil {
+			return errors.Wrap(err, "invalid stop_sequence")
+		}
+
+		// times are optional for non-timepoint stops; such rows can't be boarded or alighted by the router
+		if row["arrival_time"] == "" && row["departure_time"] == "" {
+			continue
+		}
+		arrival, err := parseGtfsTime(row["arrival_time"], row["departure_time"])
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("invalid arrival_time of trip %q", row["trip_id"]))
+		}
+		departure, err := parseGtfsTime(row["departure_time"], row["arrival_time"])
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("invalid departure_time of trip %q", row["trip_id"]))
+		}
+
+		tripStopTimes[row["trip_id"]] = append(tripStopTimes[row["trip_id"]], stopTime{sequence, stop, arrival, departure})
+	}
+
+	patternIndex := make(map[string]int)
+	for tripId, stopTimes := range tripStopTimes {
+		service, ok := tripServices[tripId]
+		if !ok {
+			return fmt.Errorf("unknown trip_id %q", tripId)
+		}
+		if len(stopTimes) < 2 {
+			continue
+		}
+
+		sort.Slice(stopTimes, func(i, j int) bool { return stopTimes[i].sequence < stopTimes[j].sequence })
+
+		trip := gtfsTrip{service: service}
+		stops := make([]int, len(stopTimes))
+		keyParts := make([]string, len(stopTimes))
+		for i, st := range stopTimes {
+			stops[i] = st.stop
+			keyParts[i] = strconv.Itoa(st.stop)
+			trip.arrivals = append(trip.arrivals, st.arrival)
+			trip.departures = append(trip.departures, st.departure)
+		}
+
+		key := strings.Join(keyParts, ",")
+		p, ok := patternIndex[key]
+		if !ok {
+			p = len(f.patterns)
+			patternIndex[key] = p
+			f.patterns = append(f.patterns, gtfsPattern{stops: stops})
+			for position, stop := range stops {
+				f.stopPatterns[stop] = append(f.stopPatterns[stop], patternPosition{p, position})
+			}
+		}
+		f.patterns[p].trips = append(f.patterns[p].trips, trip)
+	}
+
+	for _, p := range f.patterns {
+		trips := p.trips
+		sort.Slice(trips, func(i, j int) bool { return trips[i].departures[0] < trips[j].departures[0] })
+	}
+
+	return nil
+}
+
+func (f *gtfsFeed) loadTransfers(rows []map[string]string, walking WalkingModel) error {
+	explicit := make(map[[2]int]bool)
+
+	for _, row := range rows {
+		from, ok := f.stopIndex[row["from_stop_id"]]
+		if !ok {
+			return fmt.Errorf("unknown from_stop_id %q", row["from_stop_id"])
+		}
+		to, ok := f.stopIndex[row["to_stop_id"]]
+		if !ok {
+			return fmt.Errorf("unknown to_stop_id %q", row["to_stop_id"])
+		}
+		explicit[[2]int{from, to}] = true
+
+		transferType, _ := strconv.Atoi(row["transfer_type"])
+		if transferType == transferNotPossible || from == to {
+			continue
+		}
+
+		duration := walking.duration(f.stops[from].ll, f.stops[to].ll)
+		if row["min_transfer_time"] != "" {
+			duration, _ = strconv.Atoi(row["min_transfer_time"])
+		}
+		f.footpaths[from] = append(f.footpaths[from], footpath{to, duration})
+	}
+
+	index := newStopIndex(f.stops, walking.MaxTransferDistance)
+	for from, stop := range f.stops {
+		for _, to := range index.nearby(stop.ll, walking.MaxTransferDistance) {
+			if to == from || explicit[[2]int{from, to}] {
+				continue
+			}
+			f.footpaths[from] = append(f.footpaths[from], footpath{to, walking.duration(stop.ll, f.stops[to].ll)})
+		}
+	}
+
+	return nil
+}
+
+// isActive reports whether the service runs on the given date, formatted as gtfsDateLayout.
+func (s *gtfsService) isActive(date string, weekday time.Weekday) bool {
+	if s.added[date] {
+		return true
+	}
+	if s.removed[date] {
+		return false
+	}
+
+	return s.weekdays[weekday] && s.start <= date && date <= s.end
+}
+
+// parseGtfsTime parses HH:MM:SS, which may exceed 24:00:00 for trips running past midnight.
+// If the value is empty, fallback is used instead.
+func parseGtfsTime(value, fallback string) (int, error) {
+	if value == "" {
+		value = fallback
+	}
+
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+
+	var secs int
+	for _, part := range parts {
+		v, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, fmt.Errorf("invalid time %q", value)
+		}
+		secs = secs*60 + v
+	}
+
+	return secs, nil
+}
+
+// stopIndex is a lat/lng bucket index for looking up stops within walking distance.
+type stopIndex struct {
+	stops      []gtfsStop
+	bucketSize float64
+	buckets    map[[2]int][]int
+}
+
+func newStopIndex(stops []gtfsStop, radiusMeters float64) *stopIndex {
+	index := &stopIndex{
+		stops:      stops,
+		bucketSize: math.Max(radiusMeters, 1) / earthRadius,
+		buckets:    make(map[[2]int][]int),
+	}
+
+	for i, stop := range stops {
+		key := index.bucket(stop.ll)
+		index.buckets[key] = append(index.buckets[key], i)
+	}
+
+	return index
+}
+
+func (idx *stopIndex) bucket(ll s2.LatLng) [2]int {
+	return [2]int{int(math.Floor(float64(ll.Lat) / idx.bucketSize)), int(math.Floor(float64(ll.Lng) / idx.bucketSize))}
+}
+
+// nearby returns the stops within radiusMeters of ll.
+func (idx *stopIndex) nearby(ll s2.LatLng, radiusMeters float64) []int {
+	center := idx.bucket(ll)
+	radius := radiusMeters / earthRadius
+	latSpan := int(math.Ceil(radius / idx.bucketSize))
+	lngSpan := int(math.Ceil(radius / (idx.bucketSize * math.Max(math.Cos(float64(ll.Lat)), 0.01))))
+
+	var result []int
+	for i := center[0] - latSpan; i <= center[0]+latSpan; i++ {
+		for j := center[1] - lngSpan; j <= center[1]+lngSpan; j++ {
+			for _, stop := range idx.buckets[[2]int{i, j}] {
+				if distanceMeters(ll, idx.stops[stop].ll) <= radiusMeters {
+					result = append(result, stop)
+				}
+			}
+		}
+	}
+
+	return result
+}
+
+func distanceMeters(a, b s2.LatLng) float64 {
+	return float64(a.Distance(b)) * earthRadius
+}
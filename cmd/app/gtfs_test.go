@@ -0,0 +1,95 @@
+package app
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// zipTestFeed zips the files of testdata/gtfs into a temporary feed and returns its path.
+func zipTestFeed(t *testing.T) string {
+	files, err := filepath.Glob(filepath.Join("testdata", "gtfs", "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := ioutil.TempFile("", "feed*.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	archive := zip.NewWriter(out)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := archive.Create(filepath.Base(file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return out.Name()
+}
+
+func TestLoadGtfsFeed(t *testing.T) {
+	path := zipTestFeed(t)
+	defer os.Remove(path)
+
+	feed, err := loadGtfsFeed(path, DefaultWalkingModel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if feed.location.String() != "UTC" {
+		t.Errorf("got timezone %s, want UTC", feed.location)
+	}
+
+	// the generic node takes the coordinates of its station, the boarding area without a parent is skipped
+	node, ok := feed.stopIndex["NODE"]
+	if !ok {
+		t.Fatal("generic node NODE is not loaded")
+	}
+	if station := feed.stops[feed.stopIndex["STATION"]]; feed.stops[node].ll != station.ll {
+		t.Errorf("got NODE at %v, want the station at %v", feed.stops[node].ll, station.ll)
+	}
+	if _, ok := feed.stopIndex["BOARDING"]; ok {
+		t.Error("boarding area without coordinates and parent is loaded")
+	}
+
+	// T1 and T3 serve different stops, so every trip has its own pattern
+	if len(feed.patterns) != 3 {
+		t.Errorf("got %d patterns, want 3", len(feed.patterns))
+	}
+
+	weekday := feed.services[feed.serviceIndex["WEEKDAY"]]
+	weekend := feed.services[feed.serviceIndex["WEEKEND"]]
+	for _, tt := range []struct {
+		date             string
+		weekday, weekend bool
+	}{
+		{"20261019", true, false},
+		{"20261020", false, true},
+		{"20261024", false, true},
+		{"20270104", false, false},
+	} {
+		date, _ := time.Parse(gtfsDateLayout, tt.date)
+		if got := weekday.isActive(tt.date, date.Weekday()); got != tt.weekday {
+			t.Errorf("WEEKDAY on %s: got %v, want %v", tt.date, got, tt.weekday)
+		}
+		if got := weekend.isActive(tt.date, date.Weekday()); got != tt.weekend {
+			t.Errorf("WEEKEND on %s: got %v, want %v", tt.date, got, tt.weekend)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package app
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// JobFile is a declarative definition of a fetch: the area, destinations, grid, options and outputs.
+// Its keys are named after the flags of the fetch command and hold the same values,
+// points and times in particular are kept as they are written.
+// The definition is embedded in the metadata of the fetched results, so they can be fetched again.
+type JobFile struct {
+	// Corners are two opposite corners of the area, unless Area is set.
+	Corners []string `yaml:"corners,omitempty"`
+	// Area is a KML or GeoJSON file with the polygons of the area.
+	Area            string   `yaml:"area,omitempty"`
+	Destinations    []string `yaml:"dst,omitempty"`
+	DestinationFile string   `yaml:"dst_file,omitempty"`
+	Direction       string   `yaml:"direction,omitempty"`
+	// Gazetteer is a CSV file of place names, see LoadGazetteer.
+	// Without it addresses are geocoded with Google if there is an API key.
+	Gazetteer string `yaml:"gazetteer,omitempty"`
+	// Geocoded are the addresses among the points resolved by the first run, they aren't geocoded again.
+	Geocoded []GeocodedPlace `yaml:"geocoded,omitempty"`
+
+	Grid              string        `yaml:"grid,omitempty"`
+	StepMeters        int           `yaml:"step,omitempty"`
+	S2Level           int           `yaml:"s2_level,omitempty"`
+	SweepWindow       time.Duration `yaml:"sweep_window,omitempty"`
+	SweepStep         time.Duration `yaml:"sweep_step,omitempty"`
+	AdaptiveThreshold time.Duration `yaml:"adaptive_threshold,omitempty"`
+	MinStepMeters     int           `yaml:"min_step,omitempty"`
+	Budget            string        `yaml:"budget,omitempty"`
+	PricePerElement   float64       `yaml:"price_per_element,omitempty"`
+
+	Provider        string  `yaml:"provider,omitempty"`
+	Gtfs            string  `yaml:"gtfs,omitempty"`
+	WalkingSpeed    float64 `yaml:"walking_speed,omitempty"`
+	MaxWalk         float64 `yaml:"max_walk,omitempty"`
+	MaxTransferWalk float64 `yaml:"max_transfer_walk,omitempty"`
+	MaxTransfers    int     `yaml:"max_transfers,omitempty"`
+	DepartureTime   string  `yaml:"departure_time,omitempty"`
+	ArrivalTime     string  `yaml:"arrival_time,omitempty"`
+	// Holidays is a file of dates typical days skip, see LoadHolidays.
+	Holidays string `yaml:"holidays,omitempty"`
+	// Timezone is the name of the timezone of the times, the timezone of the destinations if empty.
+	Timezone          string `yaml:"timezone,omitempty"`
+	Mode              string `yaml:"mode,omitempty"`
+	Language          string `yaml:"language,omitempty"`
+	Avoid             string `yaml:"avoid,omitempty"`
+	Units             string `yaml:"units,omitempty"`
+	TransitMode       string `yaml:"transit_mode,omitempty"`
+	TransitPreference string `yaml:"transit_routing_preference,omitempty"`
+	TrafficModel      string `yaml:"traffic_model,omitempty"`
+
+	RetryFailed      bool          `yaml:"retry_failed,omitempty"`
+	RetryNudgeMeters int           `yaml:"retry_nudge,omitempty"`
+	MaxAttempts      int           `yaml:"max_attempts,omitempty"`
+	QuotaPause       time.Duration `yaml:"quota_pause,omitempty"`
+	Cache            string        `yaml:"cache,omitempty"`
+	CacheTTL         time.Duration `yaml:"cache_ttl,omitempty"`
+
+	// Output is the results file, stdout if empty.
+	Output string `yaml:"output,omitempty"`
+	// Kml, if set, is rendered from Output after the fetch.
+	Kml string `yaml:"kml,omitempty"`
+	// MaxDuration is in minutes.
+	MaxDuration int    `yaml:"max_duration,omitempty"`
+	Statistic   string `yaml:"statistic,omitempty"`
+}
+
+// LoadJobFile reads a YAML job file into job, keeping the values of the keys missing in the file.
+// Unknown keys are errors. Relative paths in the file are relative to its directory.
+// Any other file is read as a results file and job is replaced with the definition embedded in its metadata,
+// without its Output and Kml, so that running it again doesn't overwrite the file it is read from.
+func LoadJobFile(path string, job *JobFile) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+	default:
+		container, err := ReadResults(path)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("failed to read file %q", path))
+		}
+		if container.Metadata.Definition == nil {
+			return fmt.Errorf("%q has no job definition", path)
+		}
+		*job = *container.Metadata.Definition
+		job.Output, job.Kml = "", ""
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to read job file %q", path))
+	}
+
+	if err := yaml.UnmarshalStrict(data, job); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to parse job file %q", path))
+	}
+
+	return job.resolvePaths(filepath.Dir(path))
+}
+
+// resolvePaths makes the relative paths of the job absolute, relative to dir,
+// so the definition embedded in the results stays valid wherever it is run from.
+func (j *JobFile) resolvePaths(dir string) error {
+	for _, path := range []*string{&j.Area, &j.DestinationFile, &j.Gazetteer, &j.Gtfs, &j.Holidays, &j.Cache, &j.Output, &j.Kml} {
+		if *path == "" || *path == "-" || filepath.IsAbs(*path) {
+			continue
+		}
+
+		abs, err := filepath.Abs(filepath.Join(dir, *path))
+		if err != nil {
+			return err
+		}
+		*path = abs
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+package app
+
+import (
+	"fmt"
+	"github.com/golang/geo/s2"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// MergeResults merges results files of the same direction, e.g. of adjacent areas or of several days,
+// into the output file. Results of the same cell and destination found in several files are merged as samples.
+// The metadata of the first file is kept, with the destinations and the area extended to cover all files
+// and without the job definition.
+func MergeResults(files []string, output string) error {
+	if len(files) == 0 {
+		return errors.New("no files to merge")
+	}
+
+	var merged *ResultContainer
+	var areas int
+	seen := make(map[s2.LatLng]bool)
+
+	for _, file := range files {
+		container, err := ReadResults(file)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("failed to read file %q", file))
+		}
+
+		if container.Area != nil {
+			areas++
+		}
+
+		if merged == nil {
+			merged = container
+			for _, dest := range merged.Metadata.Job.Destinations {
+				seen[dest] = true
+			}
+			continue
+		}
+
+		if container.Direction != merged.Direction {
+			return fmt.Errorf("%q is %s, %s expected", file, container.Direction, merged.Direction)
+		}
+
+		for _, dest := range container.Metadata.Job.Destinations {
+			if !seen[dest] {
+				seen[dest] = true
+				merged.Metadata.Job.Destinations = append(merged.Metadata.Job.Destinations, dest)
+			}
+		}
+
+		start, end := sortRectCorners(merged.AreaStart, merged.AreaEnd)
+		rect := s2.RectFromLatLng(start).AddPoint(end)
+		rect = rect.AddPoint(container.AreaStart).AddPoint(container.AreaEnd)
+		merged.AreaStart, merged.AreaEnd = rect.Lo(), rect.Hi()
+
+		merged.Results = append(merged.Results, container.Results...)
+	}
+
+	if areas > 1 {
+		glog.Warningf("Area polygons of %d files are not merged, the area is outlined with its bounding rectangle", areas)
+		merged.Area = nil
+	}
+	merged.Metadata.Job.AreaStart, merged.Metadata.Job.AreaEnd = merged.AreaStart, merged.AreaEnd
+	if len(files) > 1 {
+		// the merged results aren't fetched by a single job
+		merged.Metadata.Definition = nil
+	}
+	merged.Results = mergeSamples(merged.Results)
+	for i := range merged.Results {
+		if len(merged.Results[i].Samples) == 1 && merged.Results[i].Unreachable == 0 {
+			// a cell found in a single file without samples
+			merged.Results[i].Samples = nil
+		}
+	}
+
+	out, err := NewResultWriter(output)
+	if err != nil {
+		return err
+	}
+
+	err = out.begin(*merged)
+	if err == nil {
+		err = out.add(merged.Results...)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to write results")
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// loadJSONLines calls fn for every line of an append-only file of JSON objects. A partially written
+// last line, left by a crash, is truncated so that new lines are appended after the last complete one.
+// It returns the number of lines passed to fn.
+func loadJSONLines(file *os.File, fn func(line []byte) error) (int, error) {
+	var offset int64
+	var lines int
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return lines, err
+		}
+		if len(line) == 0 {
+			break
+		}
+
+		trimmed := bytes.TrimSpace(line)
+		if line[len(line)-1] != '\n' || (len(trimmed) != 0 && !json.Valid(trimmed)) {
+			rest, err := ioutil.ReadAll(reader)
+			if err != nil {
+				return lines, err
+			}
+			// a crash may leave the end of the file zero-filled
+			if len(bytes.Trim(rest, " \t\r\n\x00")) != 0 {
+				return lines, fmt.Errorf("invalid JSON at offset %d of %s", offset, file.Name())
+			}
+
+			glog.Warningf("Dropping incomplete line at offset %d of %s", offset, file.Name())
+			break
+		}
+
+		if len(trimmed) != 0 {
+			if err := fn(line); err != nil {
+				return lines, err
+			}
+			lines++
+		}
+		offset += int64(len(line))
+	}
+
+	if err := file.Truncate(offset); err != nil {
+		return lines, err
+	}
+	_, err := file.Seek(offset, io.SeekStart)
+
+	return lines, err
+}
+
+// rewriteJSONLines atomically replaces the file with the lines written by fn and returns the new file
+// opened for appending. The old file is closed.
+func rewriteJSONLines(file *os.File, fn func(w io.Writer) error) (*os.File, error) {
+	path := file.Name()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	buf := bufio.NewWriter(tmp)
+	err = tmp.Chmod(0644)
+	if err == nil {
+		err = fn(buf)
+	}
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+	file.Close()
+
+	return os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644)
+}
@@ -2,7 +2,6 @@ package app
 
 import (
 	"fmt"
-	"github.com/golang/glog"
 	"googlemaps.github.io/maps"
 	"strings"
 	"time"
@@ -20,28 +19,112 @@ type Options struct {
 	TrafficModel             string
 }
 
-func (o Options) Apply(r *maps.DistanceMatrixRequest) {
+// OptionsError lists every problem of invalid options.
+type OptionsError struct {
+	Errors []error
+}
+
+func (e *OptionsError) Error() string {
+	var msgs []string
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+
+	return "invalid options: " + strings.Join(msgs, "; ")
+}
+
+// Validate checks the options for the Distance Matrix API: unknown values of every field and conflicting fields.
+// It returns *OptionsError listing all of them.
+func (o Options) Validate() error {
+	e := &OptionsError{}
+
+	if err := o.apply(&maps.DistanceMatrixRequest{}); err != nil {
+		e.Errors = append(e.Errors, err.(*OptionsError).Errors...)
+	}
+
+	e.Errors = append(e.Errors, o.conflicts()...)
+
+	if o.ArrivalTime != (time.Time{}) && o.Mode != "transit" {
+		e.Errors = append(e.Errors, fmt.Errorf("arrival_time needs transit mode"))
+	}
+	if o.TrafficModel != "" && o.Mode != "" && o.Mode != "driving" {
+		e.Errors = append(e.Errors, fmt.Errorf("traffic_model needs driving mode, got %s", o.Mode))
+	}
+	if o.TransitMode != "" && o.Mode != "transit" {
+		e.Errors = append(e.Errors, fmt.Errorf("transit_mode needs transit mode"))
+	}
+	if o.TransitRoutingPreference != "" && o.Mode != "transit" {
+		e.Errors = append(e.Errors, fmt.Errorf("transit_routing_preference needs transit mode"))
+	}
+
+	if len(e.Errors) > 0 {
+		return e
+	}
+	return nil
+}
+
+// ValidateConflicts checks the fields that conflict whatever the provider, the modes and their defaults differ.
+// It returns *OptionsError listing all of them.
+func (o Options) ValidateConflicts() error {
+	if errs := o.conflicts(); len(errs) > 0 {
+		return &OptionsError{Errors: errs}
+	}
+	return nil
+}
+
+func (o Options) conflicts() []error {
+	var errs []error
+
+	if o.DepartureTime != (time.Time{}) && o.ArrivalTime != (time.Time{}) {
+		errs = append(errs, fmt.Errorf("departure_time and arrival_time are both set"))
+	}
+	if o.TrafficModel != "" && o.DepartureTime == (time.Time{}) {
+		errs = append(errs, fmt.Errorf("traffic_model needs departure_time"))
+	}
+
+	return errs
+}
+
+// Apply sets the options of the request. It returns *OptionsError if some fields have unknown values,
+// see Validate for the conflicts of fields.
+func (o Options) Apply(r *maps.DistanceMatrixRequest) error {
+	return o.apply(r)
+}
+
+func (o Options) apply(r *maps.DistanceMatrixRequest) error {
 	r.DepartureTime = getTime(o.DepartureTime)
 	r.ArrivalTime = getTime(o.ArrivalTime)
 	r.Language = o.Language
 
-	lookupMode(o.Mode, r)
-	lookupAvoid(o.Avoid, r)
-	lookupUnits(o.Units, r)
-	lookupTransitMode(o.TransitMode, r)
-	lookupTransitRoutingPreference(o.TransitRoutingPreference, r)
-	lookupTrafficModel(o.TrafficModel, r)
+	e := &OptionsError{}
+	for _, err := range []error{
+		lookupMode(o.Mode, r),
+		lookupAvoid(o.Avoid, r),
+		lookupUnits(o.Units, r),
+		lookupTransitMode(o.TransitMode, r),
+		lookupTransitRoutingPreference(o.TransitRoutingPreference, r),
+		lookupTrafficModel(o.TrafficModel, r),
+	} {
+		if err != nil {
+			e.Errors = append(e.Errors, err)
+		}
+	}
+
+	if len(e.Errors) > 0 {
+		return e
+	}
+	return nil
 }
 
 func getTime(field time.Time) string {
-	if field == (time.Time{}){
+	if field == (time.Time{}) {
 		return ""
 	}
 
 	return fmt.Sprintf("%d", field.Unix())
 }
 
-func lookupMode(mode string, r *maps.DistanceMatrixRequest) {
+func lookupMode(mode string, r *maps.DistanceMatrixRequest) error {
 	switch mode {
 	case "driving":
 		r.Mode = maps.TravelModeDriving
@@ -54,11 +137,13 @@ func lookupMode(mode string, r *maps.DistanceMatrixRequest) {
 	case "":
 		// ignore
 	default:
-		glog.Fatalf("Unknown mode %s", mode)
+		return fmt.Errorf("unknown mode %s", mode)
 	}
+
+	return nil
 }
 
-func lookupAvoid(avoid string, r *maps.DistanceMatrixRequest) {
+func lookupAvoid(avoid string, r *maps.DistanceMatrixRequest) error {
 	switch avoid {
 	case "tolls":
 		r.Avoid = maps.AvoidTolls
@@ -69,11 +154,13 @@ func lookupAvoid(avoid string, r *maps.DistanceMatrixRequest) {
 	case "":
 		// ignore
 	default:
-		glog.Fatalf("Unknown avoid restriction %s", avoid)
+		return fmt.Errorf("unknown avoid restriction %s", avoid)
 	}
+
+	return nil
 }
 
-func lookupUnits(units string, r *maps.DistanceMatrixRequest) {
+func lookupUnits(units string, r *maps.DistanceMatrixRequest) error {
 	switch units {
 	case "metric":
 		r.Units = maps.UnitsMetric
@@ -82,11 +169,13 @@ func lookupUnits(units string, r *maps.DistanceMatrixRequest) {
 	case "":
 		// ignore
 	default:
-		glog.Fatalf("Unknown units %s", units)
+		return fmt.Errorf("unknown units %s", units)
 	}
+
+	return nil
 }
 
-func lookupTransitMode(transitMode string, r *maps.DistanceMatrixRequest) {
+func lookupTransitMode(transitMode string, r *maps.DistanceMatrixRequest) error {
 	if transitMode != "" {
 		for _, m := range strings.Split(transitMode, "|") {
 			switch m {
@@ -101,13 +190,15 @@ func lookupTransitMode(transitMode string, r *maps.DistanceMatrixRequest) {
 			case "rail":
 				r.TransitMode = append(r.TransitMode, maps.TransitModeRail)
 			default:
-				glog.Fatalf("Unknown transit_mode %s", m)
+				return fmt.Errorf("unknown transit_mode %s", m)
 			}
 		}
 	}
+
+	return nil
 }
 
-func lookupTransitRoutingPreference(transitRoutingPreference string, r *maps.DistanceMatrixRequest) {
+func lookupTransitRoutingPreference(transitRoutingPreference string, r *maps.DistanceMatrixRequest) error {
 	switch transitRoutingPreference {
 	case "fewer_transfers":
 		r.TransitRoutingPreference = maps.TransitRoutingPreferenceFewerTransfers
@@ -116,11 +207,13 @@ func lookupTransitRoutingPreference(transitRoutingPreference string, r *maps.Dis
 	case "":
 		// ignore
 	default:
-		glog.Fatalf("Unknown transit routing preference %s", transitRoutingPreference)
+		return fmt.Errorf("unknown transit routing preference %s", transitRoutingPreference)
 	}
+
+	return nil
 }
 
-func lookupTrafficModel(trafficModel string, r *maps.DistanceMatrixRequest) {
+func lookupTrafficModel(trafficModel string, r *maps.DistanceMatrixRequest) error {
 	switch trafficModel {
 	case "best_guess":
 		r.TrafficModel = maps.TrafficModelBestGuess
@@ -131,6 +224,8 @@ func lookupTrafficModel(trafficModel string, r *maps.DistanceMatrixRequest) {
 	case "":
 		// ignore
 	default:
-		glog.Fatalf("Unknown traffic_model %s", trafficModel)
+		return fmt.Errorf("unknown traffic_model %s", trafficModel)
 	}
+
+	return nil
 }
@@ -0,0 +1,172 @@
+package app
+
+import (
+	"github.com/golang/geo/s2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOptionsValidate(t *testing.T) {
+	departure := time.Date(2026, 10, 19, 8, 30, 0, 0, time.UTC)
+	arrival := departure.Add(time.Hour)
+
+	tests := []struct {
+		name      string
+		opts      Options
+		errors    []string
+		conflicts []string
+	}{
+		{name: "valid", opts: Options{Mode: "transit", DepartureTime: departure, TransitMode: "bus|subway"}},
+		{name: "default mode", opts: Options{}},
+		{
+			name:   "unknown values",
+			opts:   Options{Mode: "trasit", Avoid: "tolls|ferries", Units: "parsecs"},
+			errors: []string{"unknown mode trasit", "unknown avoid restriction tolls|ferries", "unknown units parsecs"},
+		},
+		{
+			name:      "both times",
+			opts:      Options{Mode: "transit", DepartureTime: departure, ArrivalTime: arrival},
+			errors:    []string{"departure_time and arrival_time are both set"},
+			conflicts: []string{"departure_time and arrival_time are both set"},
+		},
+		{
+			name:      "traffic model without departure",
+			opts:      Options{Mode: "driving", TrafficModel: "best_guess"},
+			errors:    []string{"traffic_model needs departure_time"},
+			conflicts: []string{"traffic_model needs departure_time"},
+		},
+		{
+			name: "mode conflicts",
+			opts: Options{Mode: "walking", ArrivalTime: arrival, TransitMode: "bus", TransitRoutingPreference: "less_walking"},
+			errors: []string{
+				"arrival_time needs transit mode",
+				"transit_mode needs transit mode",
+				"transit_routing_preference needs transit mode",
+			},
+		},
+		{
+			name: "everything at once",
+			opts: Options{Mode: "bicycling", TransitMode: "boat", TrafficModel: "best_guess", DepartureTime: departure, ArrivalTime: arrival},
+			errors: []string{
+				"unknown transit_mode boat",
+				"departure_time and arrival_time are both set",
+				"arrival_time needs transit mode",
+				"traffic_model needs driving mode, got bicycling",
+				"transit_mode needs transit mode",
+			},
+			conflicts: []string{"departure_time and arrival_time are both set"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := optionsErrors(t, tt.opts.Validate()); !reflect.DeepEqual(got, tt.errors) {
+				t.Errorf("Validate: got %q, want %q", got, tt.errors)
+			}
+			if got := optionsErrors(t, tt.opts.ValidateConflicts()); !reflect.DeepEqual(got, tt.conflicts) {
+				t.Errorf("ValidateConflicts: got %q, want %q", got, tt.conflicts)
+			}
+		})
+	}
+}
+
+// optionsErrors returns the messages of the *OptionsError err, nil if err is nil.
+func optionsErrors(t *testing.T, err error) []string {
+	if err == nil {
+		return nil
+	}
+
+	e, ok := err.(*OptionsError)
+	if !ok {
+		t.Fatalf("got %T %v, want *OptionsError", err, err)
+	}
+
+	var msgs []string
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	return msgs
+}
+
+// TestValidateOptionsProviders checks that conflicts are rejected for every provider,
+// and the options a provider doesn't support only for the providers that tell them.
+func TestValidateOptionsProviders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "options")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	feed := zipTestFeed(t)
+	defer os.Remove(feed)
+
+	google, err := NewGoogleProvider("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gtfs, err := NewGtfsProvider(feed, DefaultWalkingModel, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := OpenTravelTimeCache(filepath.Join(dir, "cache.ndjson"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	departure := time.Date(2026, 10, 19, 8, 30, 0, 0, time.UTC)
+	conflicting := Options{Mode: "transit", DepartureTime: departure, ArrivalTime: departure.Add(time.Hour)}
+	arriving := Options{Mode: "transit", ArrivalTime: departure}
+	misspelt := Options{Mode: "trasit"}
+
+	tests := []struct {
+		name     string
+		provider TravelTimeProvider
+		// arriving and misspelt are rejected by the provider
+		arriving, misspelt bool
+	}{
+		{name: "google", provider: google, misspelt: true},
+		{name: "gtfs", provider: gtfs, arriving: true, misspelt: true},
+		{name: "unknown provider", provider: &fakeProvider{}},
+		{name: "retrying google", provider: NewRetryingProvider(google, DefaultRetryPolicy), misspelt: true},
+		{name: "caching gtfs", provider: NewCachingProvider("gtfs", NewRetryingProvider(gtfs, DefaultRetryPolicy), cache),
+			arriving: true, misspelt: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateOptions(tt.provider, conflicting); err == nil {
+				t.Error("conflicting options: got no error")
+			}
+			if err := validateOptions(tt.provider, arriving); (err != nil) != tt.arriving {
+				t.Errorf("arrival time: got %v, want an error %v", err, tt.arriving)
+			}
+			if err := validateOptions(tt.provider, misspelt); (err != nil) != tt.misspelt {
+				t.Errorf("unknown mode: got %v, want an error %v", err, tt.misspelt)
+			}
+		})
+	}
+}
+
+// TestFetchInvalidOptions checks that invalid options fail the fetch once before any request.
+func TestFetchInvalidOptions(t *testing.T) {
+	provider := &fakeProvider{travelTimes: func(call int, origins, destinations []s2.LatLng) ([][]TravelTime, error) {
+		return okMatrix(origins, destinations), nil
+	}}
+
+	job := testJob()
+	job.Options.DepartureTime = time.Date(2026, 10, 19, 8, 30, 0, 0, time.UTC)
+	job.Options.ArrivalTime = job.Options.DepartureTime.Add(time.Hour)
+
+	err := FetchResults(provider, job, nil, filepath.Join(os.TempDir(), "invalid.json"))
+	if _, ok := err.(*OptionsError); !ok {
+		t.Errorf("got %v, want *OptionsError", err)
+	}
+	if provider.calls != 0 {
+		t.Errorf("got %d requests, want none", provider.calls)
+	}
+}
@@ -0,0 +1,206 @@
+package app
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// createOutput creates the output file, gzipped if its name ends with ".gz". An empty path or "-" means stdout.
+func createOutput(path string) (io.WriteCloser, error) {
+	if path == "" || path == "-" {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to create output %q", path))
+	}
+
+	if !strings.HasSuffix(path, ".gz") {
+		return file, nil
+	}
+
+	return &gzipWriter{Writer: gzip.NewWriter(file), file: file}, nil
+}
+
+// openInput opens the input file, gunzipping it if its name ends with ".gz".
+func openInput(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to open %q", path))
+	}
+
+	if !strings.HasSuffix(path, ".gz") {
+		return file, nil
+	}
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to read gzip %q", path))
+	}
+
+	return &gzipReader{Reader: reader, file: file}, nil
+}
+
+// isNDJSON reports whether the file name, without the ".gz" suffix, has the NDJSON extension.
+func isNDJSON(path string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(path, ".gz"), ".ndjson")
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// gzipWriter closes the gzip stream and then the underlying file.
+type gzipWriter struct {
+	*gzip.Writer
+	file *os.File
+}
+
+func (w *gzipWriter) Close() error {
+	err := w.Writer.Close()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+type gzipReader struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (r *gzipReader) Close() error {
+	r.Reader.Close()
+	return r.file.Close()
+}
+
+// ResultWriter writes a result file. A file named *.ndjson or *.ndjson.gz is written as the container without
+// results on the first line, followed by a result per line, so results are written as soon as they are fetched.
+// Any other file is written as a single JSON document once it is closed.
+type ResultWriter struct {
+	out       io.WriteCloser
+	buf       *bufio.Writer
+	ndjson    bool
+	container ResultContainer
+}
+
+func NewResultWriter(path string) (*ResultWriter, error) {
+	out, err := createOutput(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ResultWriter{out: out, buf: bufio.NewWriter(out), ndjson: isNDJSON(path)}, nil
+}
+
+// streaming reports whether results are written as they are added rather than on Close.
+func (w *ResultWriter) streaming() bool {
+	return w.ndjson
+}
+
+// begin sets the container the results are written to.
+func (w *ResultWriter) begin(container ResultContainer) error {
+	container.Results = nil
+	w.container = container
+
+	if !w.ndjson {
+		return nil
+	}
+
+	return w.writeLine(container)
+}
+
+func (w *ResultWriter) add(results ...Result) error {
+	if !w.ndjson {
+		w.container.Results = append(w.container.Results, results...)
+		return nil
+	}
+
+	for _, r := range results {
+		if err := w.writeLine(r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *ResultWriter) writeLine(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal json")
+	}
+
+	if _, err := w.buf.Write(append(data, '\n')); err != nil {
+		return errors.Wrap(err, "failed to write results")
+	}
+
+	return nil
+}
+
+// Close writes the buffered JSON document, if any, and closes the file.
+func (w *ResultWriter) Close() error {
+	var err error
+	if !w.ndjson {
+		err = w.writeLine(w.container)
+	}
+
+	if flushErr := w.buf.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := w.out.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// ReadResults reads a result file written by ResultWriter, or by older versions that printed it to stdout,
+// and migrates it to the latest format version.
+func ReadResults(path string) (*ResultContainer, error) {
+	in, err := openInput(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	var container ResultContainer
+	decoder := json.NewDecoder(bufio.NewReader(in))
+
+	if err := decoder.Decode(&container); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal json")
+	}
+
+	if isNDJSON(path) {
+		for {
+			var r Result
+			err := decoder.Decode(&r)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to unmarshal result")
+			}
+			container.Results = append(container.Results, r)
+		}
+	}
+
+	if err := container.migrate(); err != nil {
+		return nil, errors.Wrap(err, "failed to migrate results")
+	}
+
+	return &container, nil
+}
@@ -0,0 +1,310 @@
+package app
+
+import (
+	"fmt"
+	"github.com/golang/geo/s2"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ParsePoint parses a point written in one of the notations:
+//   - signed decimal degrees, latitude first: "55.7522, 37.6156", "-33.8688 151.2093"
+//   - degrees, minutes and seconds with hemispheres: "55°45'08\"N 37°36'56\"E", "33°52.13′S, 151°12.56′E"
+//   - geohash: "geohash:ucfv0j", or "ucfv0j" if it has a digit and at least 5 characters
+//   - full Open Location Code (plus code): "9G7VQJ2G+VR"
+//
+// Coordinates with hemispheres may go in either order, east or west first.
+// Geohashes and plus codes are parsed to the center of their cell.
+func ParsePoint(s string) (s2.LatLng, error) {
+	return parsePoint(s, true)
+}
+
+// parsePoint is ParsePoint that takes geohashes without the prefix only if bareGeohash is set.
+func parsePoint(s string, bareGeohash bool) (s2.LatLng, error) {
+	point := strings.TrimSpace(s)
+	if point == "" {
+		return s2.LatLng{}, fmt.Errorf("invalid point %q: empty", s)
+	}
+
+	var ll s2.LatLng
+	var err error
+	switch {
+	case strings.HasPrefix(strings.ToLower(point), geohashPrefix):
+		ll, err = parseGeohash(strings.TrimSpace(point[len(geohashPrefix):]))
+	case !strings.ContainsAny(point, ",;") && strings.IndexByte(point, '+') == plusCodeSeparator:
+		ll, err = parsePlusCode(point)
+	case bareGeohash && isBareGeohash(point):
+		ll, err = parseGeohash(point)
+	default:
+		ll, err = parseLatLng(point)
+	}
+	if err != nil {
+		return ll, fmt.Errorf("invalid point %q: %v", s, err)
+	}
+
+	return ll, nil
+}
+
+// parseLatLng parses a pair of decimal or DMS coordinates.
+func parseLatLng(s string) (s2.LatLng, error) {
+	var pairs [][2]string
+	if i := strings.IndexAny(s, ",;"); i >= 0 {
+		pairs = append(pairs, [2]string{s[:i], s[i+1:]})
+	} else {
+		// coordinates separated with spaces may have spaces inside, try every split
+		var prev rune
+		for i, r := range s {
+			if unicode.IsSpace(r) && !unicode.IsSpace(prev) {
+				pairs = append(pairs, [2]string{s[:i], s[i:]})
+			}
+			prev = r
+		}
+	}
+
+	var found []s2.LatLng
+	var firstErr error
+	for _, pair := range pairs {
+		ll, err := parseCoordinatePair(pair[0], pair[1])
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		found = append(found, ll)
+	}
+
+	switch {
+	case len(found) == 1:
+		return found[0], nil
+	case len(found) > 1:
+		return s2.LatLng{}, fmt.Errorf("ambiguous coordinates, separate them with a comma")
+	case firstErr != nil:
+		return s2.LatLng{}, firstErr
+	default:
+		return s2.LatLng{}, fmt.Errorf("latitude and longitude expected")
+	}
+}
+
+func parseCoordinatePair(a, b string) (s2.LatLng, error) {
+	lat, latHemisphere, err := parseCoordinate(a)
+	if err != nil {
+		return s2.LatLng{}, err
+	}
+	lng, lngHemisphere, err := parseCoordinate(b)
+	if err != nil {
+		return s2.LatLng{}, err
+	}
+
+	if isLongitudeHemisphere(latHemisphere) || isLatitudeHemisphere(lngHemisphere) {
+		lat, lng = lng, lat
+		latHemisphere, lngHemisphere = lngHemisphere, latHemisphere
+	}
+	if isLongitudeHemisphere(latHemisphere) {
+		return s2.LatLng{}, fmt.Errorf("both coordinates are longitudes")
+	}
+	if isLatitudeHemisphere(lngHemisphere) {
+		return s2.LatLng{}, fmt.Errorf("both coordinates are latitudes")
+	}
+
+	if lat < -90 || lat > 90 {
+		return s2.LatLng{}, fmt.Errorf("latitude %v is out of [-90, 90]", lat)
+	}
+	if lng < -180 || lng > 180 {
+		return s2.LatLng{}, fmt.Errorf("longitude %v is out of [-180, 180]", lng)
+	}
+
+	return s2.LatLngFromDegrees(lat, lng), nil
+}
+
+func isLatitudeHemisphere(h byte) bool {
+	return h == 'N' || h == 'S'
+}
+
+func isLongitudeHemisphere(h byte) bool {
+	return h == 'E' || h == 'W'
+}
+
+var dmsRegexp = regexp.MustCompile(`^(\d+(?:\.\d+)?|\.\d+)` +
+	`(?:\s*(?:°|º|d)\s*` +
+	`(?:(\d+(?:\.\d+)?)\s*(?:'|′|’|m)\s*` +
+	`(?:(\d+(?:\.\d+)?)\s*(?:"|″|”|''))?)?)?$`)
+
+// parseCoordinate parses signed decimal degrees or degrees, minutes and seconds with an optional hemisphere
+// before or after them. It returns the signed degrees and the hemisphere, 0 if there is none.
+func parseCoordinate(s string) (degrees float64, hemisphere byte, err error) {
+	c := strings.TrimSpace(s)
+	if c == "" {
+		return 0, 0, fmt.Errorf("missing coordinate")
+	}
+
+	if h := unicode.ToUpper(rune(c[len(c)-1])); strings.ContainsRune("NSEW", h) {
+		hemisphere = byte(h)
+		c = strings.TrimSpace(c[:len(c)-1])
+	} else if h := unicode.ToUpper(rune(c[0])); strings.ContainsRune("NSEW", h) {
+		hemisphere = byte(h)
+		c = strings.TrimSpace(c[1:])
+	}
+
+	sign := 1.0
+	if strings.HasPrefix(c, "-") || strings.HasPrefix(c, "+") {
+		if hemisphere != 0 {
+			return 0, 0, fmt.Errorf("coordinate %q has both a sign and a hemisphere", strings.TrimSpace(s))
+		}
+		if c[0] == '-' {
+			sign = -1
+		}
+		c = strings.TrimSpace(c[1:])
+	}
+	if hemisphere == 'S' || hemisphere == 'W' {
+		sign = -1
+	}
+
+	parts := dmsRegexp.FindStringSubmatch(c)
+	if parts == nil {
+		return 0, 0, fmt.Errorf("invalid coordinate %q, decimal degrees or degrees, minutes and seconds expected", strings.TrimSpace(s))
+	}
+
+	degrees, _ = strconv.ParseFloat(parts[1], 64)
+	if parts[2] != "" {
+		if strings.Contains(parts[1], ".") {
+			return 0, 0, fmt.Errorf("coordinate %q has fractional degrees and minutes", strings.TrimSpace(s))
+		}
+		minutes, _ := strconv.ParseFloat(parts[2], 64)
+		if minutes >= 60 {
+			return 0, 0, fmt.Errorf("coordinate %q has %v minutes", strings.TrimSpace(s), minutes)
+		}
+		degrees += minutes / 60
+	}
+	if parts[3] != "" {
+		if strings.Contains(parts[2], ".") {
+			return 0, 0, fmt.Errorf("coordinate %q has fractional minutes and seconds", strings.TrimSpace(s))
+		}
+		seconds, _ := strconv.ParseFloat(parts[3], 64)
+		if seconds >= 60 {
+			return 0, 0, fmt.Errorf("coordinate %q has %v seconds", strings.TrimSpace(s), seconds)
+		}
+		degrees += seconds / 3600
+	}
+
+	return sign * degrees, hemisphere, nil
+}
+
+const (
+	geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+	geohashPrefix   = "geohash:"
+	// minBareGeohash is the length of the shortest geohash taken without the prefix, a cell of about 5 km.
+	minBareGeohash = 5
+	maxGeohash     = 12
+)
+
+// isBareGeohash reports whether s is a geohash without the prefix. It must have both a digit and a letter,
+// so that neither a number nor a word, e.g. a place name, is taken for one.
+func isBareGeohash(s string) bool {
+	if len(s) < minBareGeohash || len(s) > maxGeohash {
+		return false
+	}
+
+	var letters, digits bool
+	for _, r := range strings.ToLower(s) {
+		if !strings.ContainsRune(geohashAlphabet, r) {
+			return false
+		}
+		letters = letters || unicode.IsLetter(r)
+		digits = digits || unicode.IsDigit(r)
+	}
+
+	return letters && digits
+}
+
+// parseGeohash returns the center of the geohash cell.
+func parseGeohash(s string) (s2.LatLng, error) {
+	if s == "" || len(s) > maxGeohash {
+		return s2.LatLng{}, fmt.Errorf("geohash of 1 to %d characters expected", maxGeohash)
+	}
+
+	lat := [2]float64{-90, 90}
+	lng := [2]float64{-180, 180}
+
+	even := true
+	for _, r := range strings.ToLower(s) {
+		bits := strings.IndexRune(geohashAlphabet, r)
+		if bits < 0 {
+			return s2.LatLng{}, fmt.Errorf("invalid geohash character %q", r)
+		}
+
+		for mask := 16; mask > 0; mask >>= 1 {
+			// bits alternate between longitude and latitude, longitude first
+			interval := &lat
+			if even {
+				interval = &lng
+			}
+			mid := (interval[0] + interval[1]) / 2
+			if bits&mask != 0 {
+				interval[0] = mid
+			} else {
+				interval[1] = mid
+			}
+			even = !even
+		}
+	}
+
+	return s2.LatLngFromDegrees((lat[0]+lat[1])/2, (lng[0]+lng[1])/2), nil
+}
+
+const (
+	plusCodeAlphabet  = "23456789CFGHJMPQRVWX"
+	plusCodeSeparator = 8
+	plusCodePairs     = 10
+)
+
+// parsePlusCode returns the center of the cell of a full Open Location Code, its separator is at plusCodeSeparator.
+// Short codes need a reference location and are not supported.
+func parsePlusCode(s string) (s2.LatLng, error) {
+	code := strings.ToUpper(s)
+
+	sep := strings.IndexByte(code, '+')
+	if sep != strings.LastIndexByte(code, '+') {
+		return s2.LatLng{}, fmt.Errorf("plus code has several separators")
+	}
+	if len(code)-sep-1 == 1 {
+		return s2.LatLng{}, fmt.Errorf("plus code has a single digit after the separator")
+	}
+
+	digits := code[:sep]
+	if pad := strings.IndexByte(digits, '0'); pad >= 0 {
+		if pad == 0 || pad%2 != 0 || strings.Trim(digits[pad:], "0") != "" || len(code) > sep+1 {
+			return s2.LatLng{}, fmt.Errorf("invalid plus code padding")
+		}
+		digits = digits[:pad]
+	}
+	digits += code[sep+1:]
+
+	for _, r := range digits {
+		if !strings.ContainsRune(plusCodeAlphabet, r) {
+			return s2.LatLng{}, fmt.Errorf("invalid plus code character %q", r)
+		}
+	}
+	if strings.IndexByte(plusCodeAlphabet, digits[0]) >= 9 || strings.IndexByte(plusCodeAlphabet, digits[1]) >= 18 {
+		return s2.LatLng{}, fmt.Errorf("plus code is out of range")
+	}
+
+	lat, lng := -90.0, -180.0
+	latSize, lngSize := 400.0, 400.0
+	for i := 0; i < len(digits) && i < plusCodePairs; i += 2 {
+		latSize, lngSize = latSize/20, lngSize/20
+		lat += float64(strings.IndexByte(plusCodeAlphabet, digits[i])) * latSize
+		lng += float64(strings.IndexByte(plusCodeAlphabet, digits[i+1])) * lngSize
+	}
+	for i := plusCodePairs; i < len(digits); i++ {
+		// the grid refinement splits the cell into 5 rows and 4 columns
+		latSize, lngSize = latSize/5, lngSize/4
+		d := strings.IndexByte(plusCodeAlphabet, digits[i])
+		lat += float64(d/4) * latSize
+		lng += float64(d%4) * lngSize
+	}
+
+	return s2.LatLngFromDegrees(lat+latSize/2, lng+lngSize/2), nil
+}
@@ -0,0 +1,101 @@
+package app
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+func TestParsePoint(t *testing.T) {
+	tests := []struct {
+		name     string
+		point    string
+		lat, lng float64
+		wantErr  bool
+	}{
+		{name: "decimal comma", point: "55.7522, 37.6156", lat: 55.7522, lng: 37.6156},
+		{name: "decimal space", point: "-33.8688 151.2093", lat: -33.8688, lng: 151.2093},
+		{name: "decimal semicolon", point: "55.7522;37.6156", lat: 55.7522, lng: 37.6156},
+		{name: "integer", point: "55 37", lat: 55, lng: 37},
+		{name: "signed", point: "+55.7, -37.6", lat: 55.7, lng: -37.6},
+		{name: "dms", point: `55°45'08"N 37°36'56"E`, lat: 55.752222, lng: 37.615556},
+		{name: "dms longitude first", point: `37°36'56"E 55°45'08"N`, lat: 55.752222, lng: 37.615556},
+		{name: "decimal minutes", point: "33°52.13′S, 151°12.56′E", lat: -33.868833, lng: 151.209333},
+		{name: "hemisphere prefix", point: "S33°52.13′, W151°12.56′", lat: -33.868833, lng: -151.209333},
+		{name: "sign and hemisphere", point: "-55°45'N 37E", wantErr: true},
+		{name: "both latitudes", point: "55N 37S", wantErr: true},
+		{name: "latitude out of range", point: "91, 0", wantErr: true},
+		{name: "longitude out of range", point: "0, -181", wantErr: true},
+		{name: "60 minutes", point: "55°60'N 37E", wantErr: true},
+		{name: "60 seconds", point: `55°45'60"N 37E`, wantErr: true},
+		{name: "fractional degrees and minutes", point: "55.5°30'N 37E", wantErr: true},
+		{name: "empty", point: " ", wantErr: true},
+		{name: "geohash", point: "geohash:ezs42", lat: 42.604980, lng: -5.603027},
+		{name: "bare geohash", point: "u4pruydqqvj", lat: 57.649111, lng: 10.407440},
+		{name: "empty geohash", point: "geohash:", wantErr: true},
+		{name: "invalid geohash", point: "geohash:ezs42a", wantErr: true},
+		{name: "word is no geohash", point: "Bern", wantErr: true},
+		{name: "short word is no geohash", point: "HQ", wantErr: true},
+		{name: "plus code", point: "8FVC9G8F+6X", lat: 47.365563, lng: 8.524938},
+		{name: "lowercase plus code", point: "9g7vqj2g+vr", lat: 55.752188, lng: 37.627063},
+		{name: "padded plus code", point: "7FG49Q00+", lat: 20.375, lng: 2.775},
+		{name: "invalid padding", point: "7FG49Q00+2X", wantErr: true},
+		{name: "short plus code", point: "QJ2G+VR", wantErr: true},
+		{name: "signed longitude after comma", point: "55.7,+37.6", lat: 55.7, lng: 37.6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ll, err := ParsePoint(tt.point)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParsePoint(%q) = %v, want an error", tt.point, ll)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParsePoint(%q): %v", tt.point, err)
+			}
+			if math.Abs(ll.Lat.Degrees()-tt.lat) > 1e-6 || math.Abs(ll.Lng.Degrees()-tt.lng) > 1e-6 {
+				t.Errorf("ParsePoint(%q) = %.6f,%.6f, want %.6f,%.6f", tt.point, ll.Lat.Degrees(), ll.Lng.Degrees(), tt.lat, tt.lng)
+			}
+		})
+	}
+}
+
+// TestResolveGeohashLast checks that names made of geohash characters are geocoded rather than taken for geohashes.
+func TestResolveGeohashLast(t *testing.T) {
+	resolver := &PointResolver{Geocoder: &Gazetteer{places: map[string]GeocodedPlace{
+		"bern":   {Address: "Bern", Point: "46.948,7.447"},
+		"gym123": {Address: "Gym 123", Point: "55.75,37.62"},
+	}}}
+
+	tests := []struct {
+		point    string
+		lat, lng float64
+		wantErr  bool
+	}{
+		{point: "Bern", lat: 46.948, lng: 7.447},
+		{point: "gym123", lat: 55.75, lng: 37.62},
+		{point: "u4pruydqqvj", lat: 57.649111, lng: 10.407440},
+		{point: "geohash:ezs42", lat: 42.604980, lng: -5.603027},
+		{point: "HQ", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		ll, err := resolver.Resolve(context.Background(), tt.point)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Resolve(%q) = %v, want an error", tt.point, ll)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Resolve(%q): %v", tt.point, err)
+			continue
+		}
+		if math.Abs(ll.Lat.Degrees()-tt.lat) > 1e-6 || math.Abs(ll.Lng.Degrees()-tt.lng) > 1e-6 {
+			t.Errorf("Resolve(%q) = %.6f,%.6f, want %.6f,%.6f", tt.point, ll.Lat.Degrees(), ll.Lng.Degrees(), tt.lat, tt.lng)
+		}
+	}
+}
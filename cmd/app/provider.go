@@ -0,0 +1,54 @@
+package app
+
+import (
+	"context"
+	"github.com/golang/geo/s2"
+	"time"
+)
+
+const (
+	StatusOK = "OK"
+	// StatusError is the status of the elements of a request that failed, e.g. after running out of retries.
+	StatusError = "ERROR"
+)
+
+// TravelTime is a travel time calculated by a provider for a single origin-destination pair.
+type TravelTime struct {
+	// Status is StatusOK if the pair is routable, or a provider-specific status otherwise.
+	Status string
+	// Duration is the travel time of the pair: DurationInTraffic if the provider returned it, BaseDuration otherwise.
+	Duration time.Duration
+	// BaseDuration is the travel time without traffic.
+	BaseDuration time.Duration
+	// DurationInTraffic is the travel time in current or predicted traffic, zero if unknown.
+	DurationInTraffic time.Duration
+	// Distance is the route length in meters.
+	Distance int
+	// OriginAddress and DestinationAddress are the addresses the provider snapped the points to, if it does.
+	OriginAddress, DestinationAddress string
+}
+
+// TravelTimeProvider calculates travel times between origins and destinations.
+type TravelTimeProvider interface {
+	// TravelTimes returns a matrix of travel times indexed as [origin][destination].
+	TravelTimes(ctx context.Context, origins, destinations []s2.LatLng, opts Options) ([][]TravelTime, error)
+}
+
+// OptionsValidator is implemented by the providers that know the options they support,
+// so that FetchResults rejects invalid options once instead of failing every request.
+type OptionsValidator interface {
+	ValidateOptions(opts Options) error
+}
+
+// validateOptions checks the options that conflict for any provider and, if it tells, the ones the provider doesn't support.
+func validateOptions(provider TravelTimeProvider, opts Options) error {
+	if err := opts.ValidateConflicts(); err != nil {
+		return err
+	}
+
+	if v, ok := provider.(OptionsValidator); ok {
+		return v.ValidateOptions(opts)
+	}
+
+	return nil
+}
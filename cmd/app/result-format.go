@@ -0,0 +1,154 @@
+package app
+
+import (
+	"fmt"
+	"github.com/golang/geo/s2"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ResultVersion is the version of the result file format written by FetchResults.
+// Files without a version were written before the format was versioned and are version 1.
+const ResultVersion = 2
+
+// Metadata describes how the results of a file were fetched.
+type Metadata struct {
+	Job FetchJob
+	// Definition is the job file to fetch the results again, see LoadJobFile.
+	// It is missing in files fetched before job files were introduced.
+	Definition *JobFile `json:",omitempty"`
+	// FetchedAt is zero for files migrated from version 1.
+	FetchedAt time.Time
+}
+
+// migrate upgrades the container read from a file of an older version to ResultVersion.
+func (c *ResultContainer) migrate() error {
+	if c.Version > ResultVersion {
+		return fmt.Errorf("unsupported result file version %d, the latest known is %d", c.Version, ResultVersion)
+	}
+
+	if c.Version == 0 {
+		// version 1 files have no metadata and may predate directions, destinations and statuses
+		if c.Direction == "" {
+			c.Direction = DirectionInbound
+		}
+
+		for i, r := range c.Results {
+			if r.Status == "" {
+				c.Results[i].Status = StatusOK
+			}
+		}
+	}
+
+	if c.Metadata == nil {
+		// version 1 files, or files whose metadata was dropped by hand
+		job := FetchJob{AreaStart: c.AreaStart, AreaEnd: c.AreaEnd, Direction: c.Direction}
+		seen := make(map[s2.LatLng]bool)
+		for _, r := range c.Results {
+			if r.Destination != (s2.LatLng{}) && !seen[r.Destination] {
+				seen[r.Destination] = true
+				job.Destinations = append(job.Destinations, r.Destination)
+			}
+		}
+
+		c.Metadata = &Metadata{Job: job}
+	}
+
+	c.Version = ResultVersion
+
+	return nil
+}
+
+// title returns the name of the rendered map.
+func (m *Metadata) title() string {
+	job := m.Job
+
+	mode := job.Options.Mode
+	if mode == "" {
+		mode = "travel"
+	}
+
+	var to string
+	switch len(job.Destinations) {
+	case 0:
+		to = "destination"
+	case 1:
+		to = latLonToString(job.Destinations[0])
+	default:
+		to = fmt.Sprintf("%d destinations", len(job.Destinations))
+	}
+
+	if job.Direction == DirectionOutbound {
+		return fmt.Sprintf("%s from %s", capitalize(mode), to)
+	}
+	return fmt.Sprintf("%s to %s", capitalize(mode), to)
+}
+
+// capitalize returns s with its first letter in upper case.
+func capitalize(s string) string {
+	r, size := utf8.DecodeRuneInString(s)
+	if r == utf8.RuneError {
+		return s
+	}
+
+	return string(unicode.ToUpper(r)) + s[size:]
+}
+
+// description returns the parameters of the fetch, one per line.
+func (m *Metadata) description(statistic Statistic) string {
+	job := m.Job
+	var lines []string
+
+	add := func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+
+	if job.Provider != "" {
+		add("provider: %s", job.Provider)
+	}
+	// times are read back with a fixed offset, format them in the timezone they were given in
+	loc := time.Local
+	if job.Timezone != "" {
+		if l, err := time.LoadLocation(job.Timezone); err == nil {
+			loc = l
+		}
+	}
+	if job.Options.DepartureTime != (time.Time{}) {
+		add("departure: %s", job.Options.DepartureTime.In(loc).Format(time.RFC1123))
+	}
+	if job.Options.ArrivalTime != (time.Time{}) {
+		add("arrival: %s", job.Options.ArrivalTime.In(loc).Format(time.RFC1123))
+	}
+	if job.Timezone != "" {
+		add("timezone: %s", job.Timezone)
+	}
+	if job.Options.TransitMode != "" {
+		add("transit mode: %s", job.Options.TransitMode)
+	}
+	if job.Options.TrafficModel != "" {
+		add("traffic model: %s", job.Options.TrafficModel)
+	}
+	if job.Options.Avoid != "" {
+		add("avoid: %s", job.Options.Avoid)
+	}
+	if job.StepMeters > 0 {
+		grid := job.Grid
+		if grid == "" {
+			grid = GridSquare
+		}
+		add("grid: %s, step %d m", grid, job.StepMeters)
+	}
+	if job.SweepWindow > 0 {
+		add("sweep: %v every %v, %s rendered", job.SweepWindow, job.SweepStep, statistic)
+	}
+	if job.AdaptiveThreshold > 0 {
+		add("adaptive refinement: %v threshold, min step %d m", job.AdaptiveThreshold, job.MinStepMeters)
+	}
+	if m.FetchedAt != (time.Time{}) {
+		add("fetched: %s", m.FetchedAt.Format(time.RFC1123))
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,83 @@
+package app
+
+import (
+	"github.com/golang/geo/s1"
+	"github.com/golang/geo/s2"
+	"github.com/golang/glog"
+	"math"
+)
+
+// retryFailed re-queries the cells without a travel time to some destination and replaces their failed results.
+// Retries bypass the checkpoint, which already holds the failed elements.
+// Failed batches are reported only if their elements failed on the last retry too.
+func (f *fetcher) retryFailed(results []Result) []Result {
+	for attempt, nudge := range f.retryNudges() {
+		failed := make(map[resultKey]int)
+		retried := make(map[s2.LatLng]bool)
+		var cells []cell
+		var points []s2.LatLng
+
+		for i, r := range results {
+			if r.ok() {
+				continue
+			}
+
+			failed[r.key()] = i
+			if !retried[r.Center] {
+				retried[r.Center] = true
+				cells = append(cells, f.cells[r.Center])
+				points = append(points, nudge(r.Center))
+			}
+		}
+
+		if len(cells) == 0 {
+			break
+		}
+		glog.Infof("Retry %d: re-querying %d failed cells", attempt+1, len(cells))
+
+		previous := f.err.Failures
+		f.err.Failures = nil
+
+		for _, r := range f.fetchAt(cells, points, nil) {
+			if i, ok := failed[r.key()]; ok {
+				results[i] = r
+			}
+		}
+
+		// the failures of the retried elements are replaced with the ones of the retry
+		var kept []BatchFailure
+		for _, failure := range previous {
+			for _, k := range failure.cells {
+				if _, ok := failed[k]; !ok {
+					kept = append(kept, failure)
+					break
+				}
+			}
+		}
+		f.err.Failures = append(kept, f.err.Failures...)
+	}
+
+	return results
+}
+
+// retryNudges returns the origin of every retry pass for a cell center.
+func (f *fetcher) retryNudges() []func(s2.LatLng) s2.LatLng {
+	if f.job.RetryNudgeMeters <= 0 {
+		return []func(s2.LatLng) s2.LatLng{func(center s2.LatLng) s2.LatLng { return center }}
+	}
+
+	step := s1.Angle(float64(f.job.RetryNudgeMeters) / earthRadius)
+
+	var nudges []func(s2.LatLng) s2.LatLng
+	for _, d := range [][2]s1.Angle{{1, 0}, {0, 1}, {-1, 0}, {0, -1}} {
+		dLat, dLng := d[0], d[1]
+		nudges = append(nudges, func(center s2.LatLng) s2.LatLng {
+			return s2.LatLng{
+				Lat: center.Lat + dLat*step,
+				Lng: center.Lng + dLng*step/s1.Angle(math.Cos(center.Lat.Radians())),
+			}
+		})
+	}
+
+	return nudges
+}
@@ -0,0 +1,197 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/geo/s2"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+type ErrorClass int
+
+const (
+	// ErrorPermanent is an error that won't go away on retry, e.g. an invalid request.
+	ErrorPermanent ErrorClass = iota
+	// ErrorTransient is an error that may go away on retry, e.g. a network timeout.
+	ErrorTransient
+	// ErrorQuota is an error caused by exceeding the API quota; requests have to be slowed down.
+	ErrorQuota
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorTransient:
+		return "transient"
+	case ErrorQuota:
+		return "quota"
+	default:
+		return "permanent"
+	}
+}
+
+// ProviderError is an error classified by a provider.
+type ProviderError struct {
+	Class ErrorClass
+	Err   error
+}
+
+func (e *ProviderError) Error() string {
+	return fmt.Sprintf("%s error: %v", e.Class, e.Err)
+}
+
+func (e *ProviderError) Cause() error {
+	return e.Err
+}
+
+// statusClasses are the classes of the request statuses of the Google Maps APIs, other statuses are permanent errors.
+var statusClasses = map[string]ErrorClass{
+	"OVER_QUERY_LIMIT":        ErrorQuota,
+	"OVER_DAILY_LIMIT":        ErrorQuota,
+	"RESOURCE_EXHAUSTED":      ErrorQuota,
+	"UNKNOWN_ERROR":           ErrorTransient,
+	"INVALID_REQUEST":         ErrorPermanent,
+	"REQUEST_DENIED":          ErrorPermanent,
+	"MAX_ELEMENTS_EXCEEDED":   ErrorPermanent,
+	"MAX_DIMENSIONS_EXCEEDED": ErrorPermanent,
+}
+
+// ClassifyError tells whether the error is worth retrying.
+func ClassifyError(err error) ErrorClass {
+	for e := err; e != nil; {
+		if pe, ok := e.(*ProviderError); ok {
+			return pe.Class
+		}
+
+		cause, ok := e.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		e = cause.Cause()
+	}
+
+	cause := errors.Cause(err)
+	if cause == context.Canceled || cause == context.DeadlineExceeded {
+		return ErrorPermanent
+	}
+	if _, ok := cause.(net.Error); ok {
+		return ErrorTransient
+	}
+	if _, ok := cause.(*json.SyntaxError); ok {
+		// an HTML error page instead of the API response
+		return ErrorTransient
+	}
+
+	return ErrorPermanent
+}
+
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// QuotaPause is the pause after a quota error, before the request rate is halved.
+	QuotaPause time.Duration
+	// MinRate is the lowest request rate per second the provider slows down to.
+	MinRate float64
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: time.Second,
+	MaxBackoff:     time.Minute,
+	QuotaPause:     30 * time.Second,
+	MinRate:        0.1,
+}
+
+// RetryingProvider is a TravelTimeProvider that retries transient and quota errors of the underlying provider
+// with exponential backoff. On quota errors it pauses and halves the request rate.
+type RetryingProvider struct {
+	provider TravelTimeProvider
+	policy   RetryPolicy
+	limiter  *rate.Limiter
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func NewRetryingProvider(provider TravelTimeProvider, policy RetryPolicy) *RetryingProvider {
+	return &RetryingProvider{
+		provider: provider,
+		policy:   policy,
+		limiter:  rate.NewLimiter(rate.Inf, 1),
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (p *RetryingProvider) ValidateOptions(opts Options) error {
+	return validateOptions(p.provider, opts)
+}
+
+func (p *RetryingProvider) TravelTimes(ctx context.Context, origins, destinations []s2.LatLng, opts Options) ([][]TravelTime, error) {
+	backoff := p.policy.InitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		if err := p.limiter.Wait(ctx); err != nil {
+			return nil, &ProviderError{Class: ErrorPermanent, Err: err}
+		}
+
+		matrix, err := p.provider.TravelTimes(ctx, origins, destinations, opts)
+		if err == nil {
+			return matrix, nil
+		}
+
+		class := ClassifyError(err)
+		if class == ErrorPermanent || attempt >= p.policy.MaxAttempts {
+			return nil, &ProviderError{Class: class, Err: errors.Wrap(err, fmt.Sprintf("failed after %d attempts", attempt))}
+		}
+
+		pause := p.jitter(backoff)
+		if class == ErrorQuota {
+			pause += p.policy.QuotaPause
+			p.slowDown()
+		}
+		glog.Warningf("Retrying %s error in %v (attempt %d/%d): %v", class, pause, attempt, p.policy.MaxAttempts, err)
+
+		select {
+		case <-time.After(pause):
+		case <-ctx.Done():
+			return nil, &ProviderError{Class: ErrorPermanent, Err: ctx.Err()}
+		}
+
+		backoff *= 2
+		if backoff > p.policy.MaxBackoff {
+			backoff = p.policy.MaxBackoff
+		}
+	}
+}
+
+// jitter returns a random duration between d/2 and d, so that workers don't retry in lockstep.
+func (p *RetryingProvider) jitter(d time.Duration) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return d/2 + time.Duration(p.rand.Int63n(int64(d/2)+1))
+}
+
+func (p *RetryingProvider) slowDown() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	limit := p.limiter.Limit()
+	if limit == rate.Inf {
+		limit = rate.Limit(workers)
+	}
+	limit /= 2
+	if limit < rate.Limit(p.policy.MinRate) {
+		limit = rate.Limit(p.policy.MinRate)
+	}
+
+	p.limiter.SetLimit(limit)
+	glog.Warningf("Request rate slowed down to %.2f/s", float64(limit))
+}
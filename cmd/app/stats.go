@@ -0,0 +1,67 @@
+package app
+
+import (
+	"fmt"
+	"github.com/golang/geo/s2"
+	"github.com/pkg/errors"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// WriteStats writes a table of travel time statistics per destination of the results file:
+// the number of cells, how many of them are unreachable or within maxDuration, and the travel time distribution.
+func WriteStats(file, output string, maxDuration time.Duration) error {
+	container, err := ReadResults(file)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("failed to read file %q", file))
+	}
+
+	var dests []s2.LatLng
+	durations := make(map[s2.LatLng][]time.Duration)
+	cells := make(map[s2.LatLng]int)
+	for _, r := range container.Results {
+		if _, ok := cells[r.Destination]; !ok {
+			dests = append(dests, r.Destination)
+		}
+		cells[r.Destination]++
+		if r.ok() {
+			durations[r.Destination] = append(durations[r.Destination], r.Duration)
+		}
+	}
+
+	out, err := createOutput(output)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "destination\tcells\tunreachable\twithin %v\tmin\tp10\tmedian\tp90\tmax\t\n", maxDuration)
+
+	for _, dest := range dests {
+		reachable := durations[dest]
+		sort.Slice(reachable, func(i, j int) bool { return reachable[i] < reachable[j] })
+
+		within := sort.Search(len(reachable), func(i int) bool { return reachable[i] > maxDuration })
+
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t", latLonToString(dest), cells[dest], cells[dest]-len(reachable), within)
+		for _, s := range []Statistic{"min", "p10", StatisticMedian, "p90", "max"} {
+			if len(reachable) == 0 {
+				fmt.Fprint(w, "-\t")
+				continue
+			}
+			fmt.Fprintf(w, "%.0f min\t", s.apply(reachable).Minutes())
+		}
+		fmt.Fprintln(w)
+	}
+
+	err = w.Flush()
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to write stats")
+	}
+
+	return nil
+}
@@ -0,0 +1,166 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Statistic summarizes travel times sampled over a time window:
+// "median", "min", "max", "worst" (same as max) or a percentile such as "p10" or "p90".
+type Statistic string
+
+const StatisticMedian Statistic = "median"
+
+func ParseStatistic(s string) (Statistic, error) {
+	if _, err := Statistic(s).percentile(); err != nil {
+		return "", err
+	}
+
+	return Statistic(s), nil
+}
+
+func (s Statistic) percentile() (float64, error) {
+	switch s {
+	case StatisticMedian, "":
+		return 50, nil
+	case "min":
+		return 0, nil
+	case "max", "worst":
+		return 100, nil
+	}
+
+	if strings.HasPrefix(string(s), "p") {
+		p, err := strconv.ParseFloat(strings.TrimPrefix(string(s), "p"), 64)
+		if err == nil && p >= 0 && p <= 100 {
+			return p, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown statistic %q", s)
+}
+
+// apply returns the statistic of the sorted samples using the nearest-rank method.
+func (s Statistic) apply(samples []time.Duration) time.Duration {
+	d, _ := s.applyWithUnreachable(samples, 0)
+	return d
+}
+
+// applyWithUnreachable returns the statistic of the sorted samples along with the unreachable ones,
+// which count as infinite travel times. It returns false if the statistic is one of the unreachable samples.
+func (s Statistic) applyWithUnreachable(samples []time.Duration, unreachable int) (time.Duration, bool) {
+	p, err := s.percentile()
+	if err != nil || len(samples) == 0 {
+		return 0, false
+	}
+
+	rank := int(math.Ceil(p/100*float64(len(samples)+unreachable))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(samples) {
+		return 0, false
+	}
+
+	return samples[rank], true
+}
+
+// statistic returns the statistic of the sampled travel times of the result, false if the cell is unreachable by it.
+func (r Result) statistic(s Statistic) (time.Duration, bool) {
+	if len(r.Samples) == 0 && r.Unreachable == 0 {
+		return r.Duration, r.ok()
+	}
+
+	return s.applyWithUnreachable(r.Samples, r.Unreachable)
+}
+
+// sweep returns the options of every sampled departure or arrival time of the job.
+func (j FetchJob) sweep() ([]Options, error) {
+	if j.SweepStep == 0 && j.SweepWindow == 0 {
+		return []Options{j.Options}, nil
+	}
+	if j.SweepStep <= 0 || j.SweepWindow < 0 {
+		return nil, fmt.Errorf("invalid sweep step %v and window %v", j.SweepStep, j.SweepWindow)
+	}
+
+	start, field := j.Options.DepartureTime, "DepartureTime"
+	if start == (time.Time{}) {
+		start, field = j.Options.ArrivalTime, "ArrivalTime"
+	}
+	if start == (time.Time{}) {
+		return nil, errors.New("sweep requires departure or arrival time")
+	}
+
+	var sweep []Options
+	for offset := time.Duration(0); offset <= j.SweepWindow; offset += j.SweepStep {
+		opts := j.Options
+		if field == "DepartureTime" {
+			opts.DepartureTime = start.Add(offset)
+		} else {
+			opts.ArrivalTime = start.Add(offset)
+		}
+		sweep = append(sweep, opts)
+	}
+
+	return sweep, nil
+}
+
+// mergeSamples merges the results of the same cell and destination fetched at different times.
+// Times the cell is unreachable at are counted in Unreachable, the cell is unreachable if the median is.
+func mergeSamples(results []Result) []Result {
+	var merged []Result
+	index := make(map[resultKey]int)
+	statuses := make(map[resultKey]string)
+
+	for _, r := range results {
+		k := r.key()
+
+		samples, unreachable := r.Samples, r.Unreachable
+		if len(samples) == 0 && unreachable == 0 {
+			switch {
+			case r.ok():
+				samples = []time.Duration{r.Duration}
+			case r.Status != StatusError:
+				// a failed request tells nothing about the cell
+				unreachable = 1
+			}
+		}
+		if !r.ok() && (statuses[k] == "" || statuses[k] == StatusError) {
+			statuses[k] = r.Status
+		}
+
+		i, ok := index[k]
+		if !ok {
+			i = len(merged)
+			index[k] = i
+			r.Samples, r.Unreachable = nil, 0
+			merged = append(merged, r)
+		}
+		if len(samples) > 0 && len(merged[i].Samples) == 0 {
+			// the first reachable sample provides the distance and the addresses
+			r.Samples, r.Unreachable = nil, merged[i].Unreachable
+			merged[i] = r
+		}
+		merged[i].Samples = append(merged[i].Samples, samples...)
+		merged[i].Unreachable += unreachable
+	}
+
+	for i := range merged {
+		samples := merged[i].Samples
+		sort.Slice(samples, func(a, b int) bool { return samples[a] < samples[b] })
+
+		median, ok := StatisticMedian.applyWithUnreachable(samples, merged[i].Unreachable)
+		switch {
+		case ok:
+			merged[i].Status, merged[i].Duration = StatusOK, median
+		case len(samples) > 0:
+			merged[i].Status, merged[i].Duration = statuses[merged[i].key()], 0
+		}
+	}
+
+	return merged
+}
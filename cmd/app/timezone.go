@@ -0,0 +1,84 @@
+package app
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"github.com/golang/geo/s2"
+	"github.com/pkg/errors"
+	"googlemaps.github.io/maps"
+	"time"
+)
+
+// TimezoneLookup resolves the timezone of a point.
+type TimezoneLookup interface {
+	// Timezone returns the timezone at the point. The time picks the daylight saving rules where it matters.
+	Timezone(ctx context.Context, ll s2.LatLng, at time.Time) (*time.Location, error)
+}
+
+// GoogleTimezoneLookup is a TimezoneLookup backed by the Google Time Zone API.
+type GoogleTimezoneLookup struct {
+	client *maps.Client
+}
+
+func NewGoogleTimezoneLookup(apiKey string, options ...maps.ClientOption) (*GoogleTimezoneLookup, error) {
+	client, err := maps.NewClient(append([]maps.ClientOption{maps.WithAPIKey(apiKey)}, options...)...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create client")
+	}
+
+	return &GoogleTimezoneLookup{client: client}, nil
+}
+
+func (l *GoogleTimezoneLookup) Timezone(ctx context.Context, ll s2.LatLng, at time.Time) (*time.Location, error) {
+	r := &maps.TimezoneRequest{
+		Location:  &maps.LatLng{Lat: ll.Lat.Degrees(), Lng: ll.Lng.Degrees()},
+		Timestamp: at,
+	}
+
+	result, err := l.client.Timezone(ctx, r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to process request")
+	}
+
+	loc, err := time.LoadLocation(result.TimeZoneID)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("unknown timezone %q", result.TimeZoneID))
+	}
+
+	return loc, nil
+}
+
+// GtfsTimezoneLookup is an offline TimezoneLookup that takes the agency timezone of a GTFS feed for any point
+// served by the feed. It is the timezone the feed schedules are in.
+type GtfsTimezoneLookup struct {
+	Feed string
+}
+
+func (l GtfsTimezoneLookup) Timezone(ctx context.Context, ll s2.LatLng, at time.Time) (*time.Location, error) {
+	archive, err := zip.OpenReader(l.Feed)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to open GTFS feed %q", l.Feed))
+	}
+	defer archive.Close()
+
+	files := make(map[string]*zip.File)
+	for _, f := range archive.File {
+		files[f.Name] = f
+	}
+
+	rows, err := readGtfsFile(files, "agency.txt", false)
+	if err != nil {
+		return nil, err
+	}
+
+	var feed gtfsFeed
+	if err := feed.loadAgency(rows); err != nil {
+		return nil, errors.Wrap(err, "invalid agency.txt")
+	}
+	if feed.location == nil {
+		return nil, fmt.Errorf("GTFS feed %q has no agency_timezone", l.Feed)
+	}
+
+	return feed.location, nil
+}
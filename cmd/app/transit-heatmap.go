@@ -3,7 +3,6 @@ package app
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"github.com/golang/geo/s1"
 	"github.com/golang/geo/s2"
@@ -11,164 +10,530 @@ import (
 	"github.com/kr/pretty"
 	"github.com/pkg/errors"
 	"github.com/twpayne/go-kml"
-	"googlemaps.github.io/maps"
 	"image/color"
-	"io/ioutil"
 	"math"
 	"time"
 )
 
 const (
-	maxElements = 25
 	earthRadius = 6378137
 	workers     = 20
 )
 
+type Direction string
+
+const (
+	// DirectionInbound measures travel times from every cell to the destination.
+	DirectionInbound Direction = "inbound"
+	// DirectionOutbound measures travel times from the destination to every cell.
+	DirectionOutbound Direction = "outbound"
+)
+
+func ParseDirection(s string) (Direction, error) {
+	switch d := Direction(s); d {
+	case DirectionInbound, DirectionOutbound:
+		return d, nil
+	default:
+		return "", fmt.Errorf("unknown direction %q", s)
+	}
+}
+
 type Result struct {
 	Center, A, C s2.LatLng
-	Duration     time.Duration
+	// Status is the element status of the provider. Unreachable and failed cells have a zero Duration.
+	// It is empty in files fetched before statuses were recorded, which means OK.
+	Status string
+	// Destination is the fixed point of the isochrone. For the outbound direction it is the origin of the trip.
+	Destination s2.LatLng
+	// Duration is the median of Samples and Unreachable if travel times were sampled over a time window.
+	// It is DurationInTraffic if the provider returned it, BaseDuration otherwise.
+	Duration time.Duration
+	// BaseDuration, DurationInTraffic, Distance and the addresses are those of the first sampled time the cell was reachable at.
+	BaseDuration      time.Duration `json:",omitempty"`
+	DurationInTraffic time.Duration `json:",omitempty"`
+	// Distance is the route length in meters.
+	Distance int `json:",omitempty"`
+	// CellAddress and DestinationAddress are the addresses the provider snapped the cell center and the destination to.
+	CellAddress, DestinationAddress string `json:",omitempty"`
+	// Samples are the sorted travel times sampled over a time window.
+	Samples []time.Duration `json:",omitempty"`
+	// Unreachable is the number of sampled times the cell was unreachable at.
+	// They count as infinite travel times in the statistics of Samples.
+	Unreachable int `json:",omitempty"`
+	// CellID is the token of the S2 cell sampled by the result, if the area was covered with S2 cells.
+	CellID string `json:",omitempty"`
+	// Vertices is the outline of the cell if it isn't the rectangle of A and C.
+	Vertices []s2.LatLng `json:",omitempty"`
+}
+
+// ok reports whether the cell has a travel time to the destination.
+func (r Result) ok() bool {
+	return r.Status == "" || r.Status == StatusOK
+}
+
+// resultKey identifies the cell and the destination of a result.
+type resultKey struct {
+	center, destination string
+}
+
+func (r Result) key() resultKey {
+	return resultKey{latLonToString(r.Center), latLonToString(r.Destination)}
 }
 
 type ResultContainer struct {
+	// Version is the format version of the file, see ResultVersion.
+	Version int
+	// Metadata is nil only in files of version 1 before their migration.
+	Metadata           *Metadata `json:",omitempty"`
 	AreaStart, AreaEnd s2.LatLng
-	Results            []Result
+	// Direction is empty for files fetched before outbound direction support, which means inbound.
+	Direction Direction
+	// Area is the polygon the cells were limited to, if any.
+	Area    *Area    `json:",omitempty"`
+	Results []Result `json:",omitempty"`
+}
+
+// BatchFailure is a batch of origins and destinations that couldn't be fetched.
+type BatchFailure struct {
+	Origins      []s2.LatLng
+	Destinations []s2.LatLng
+	Class        ErrorClass
+	Err          error
+
+	// cells are the cells and destinations of the failed elements.
+	cells []resultKey
+}
+
+// FetchError is returned by FetchResults when some batches failed. Results of the other batches are still output.
+type FetchError struct {
+	Failures []BatchFailure
+	// Total is the number of elements requested, not counting retries.
+	Total int
 }
 
-func FetchResults(apiKey string, dest, areaStart, areaEnd s2.LatLng, stepMeters int, opts Options) error {
-	stepLat := s1.Angle(float64(stepMeters) / earthRadius)
-	stepLon := s1.Angle(float64(stepMeters) / (earthRadius * math.Cos(float64(dest.Lat))))
+func (e *FetchError) Error() string {
+	var failed int
+	for _, f := range e.Failures {
+		failed += len(f.Origins) * len(f.Destinations)
+	}
+
+	return fmt.Sprintf("%d/%d elements failed in %d batches, first error: %v", failed, e.Total, len(e.Failures), e.Failures[0].Err)
+}
+
+type batchResult struct {
+	batch
+	results []Result
+	err     error
+	// checkpointErr is the error of appending the fetched results to the checkpoint, they are valid nevertheless.
+	checkpointErr error
+}
 
-	origins, err := getLatLngsInRect(areaStart, areaEnd, stepLat, stepLon)
+// FetchJob describes the travel times fetched by FetchResults.
+type FetchJob struct {
+	Destinations       []s2.LatLng
+	AreaStart, AreaEnd s2.LatLng
+	StepMeters         int
+	Direction          Direction
+	Options            Options
+	// Timezone is the name of the timezone the departure and arrival times of Options were given in,
+	// the timezone of the destinations. It is empty in files fetched before it was recorded.
+	Timezone string
+	// Grid is the shape of the sampled cells, square if empty.
+	Grid Grid
+	// S2Level is the level of the S2 cells of the s2 grid, 0 picks the level with the edge closest to StepMeters.
+	S2Level int
+	// Area, if set, limits the sampled cells to those centered in it. AreaStart and AreaEnd have to bound it.
+	// It is stored in the result container rather than in the metadata.
+	Area *Area `json:"-"`
+	// SweepWindow and SweepStep, if set, sample travel times every SweepStep within SweepWindow
+	// from the departure or arrival time in Options.
+	SweepWindow, SweepStep time.Duration
+	// AdaptiveThreshold, if set, subdivides cells whose travel time differs from a neighbouring cell by more than it,
+	// until the step gets below MinStepMeters or MaxElements are fetched.
+	AdaptiveThreshold time.Duration
+	MinStepMeters     int
+	// MaxElements limits the elements fetched by adaptive refinement, 0 means unlimited.
+	MaxElements int
+	// Provider names the travel time provider in the result metadata.
+	Provider string
+	// RetryFailed re-queries the cells without a travel time to some destination after the fetch.
+	// If RetryNudgeMeters is set, the origins of such cells are moved that far north, east, south and west in turn
+	// while they keep failing.
+	RetryFailed      bool
+	RetryNudgeMeters int
+	// Definition, if set, is the job file the job was made of. It is stored in the result metadata.
+	Definition *JobFile `json:"-"`
+}
+
+// FetchResults fetches travel times from the area to every destination and writes them to the output file,
+// see ResultWriter. If checkpoint is not nil, every fetched batch is appended to it and origin-destination pairs
+// fetched by a previous run are skipped.
+// Batches that fail are skipped and reported with *FetchError after the other results are output.
+// Batches that fail to be appended to the checkpoint are output nevertheless and reported after them.
+func FetchResults(provider TravelTimeProvider, job FetchJob, checkpoint *Checkpoint, output string) error {
+	if len(job.Destinations) == 0 {
+		return errors.New("no destinations")
+	}
+
+	// the provider would reject every request
+	if err := validateOptions(provider, job.Options); err != nil {
+		return err
+	}
+
+	cells, err := job.cells()
 	if err != nil {
 		return errors.Wrap(err, "faled to get src points")
 	}
 
-	resultsCh := make(chan []Result)
-	originsCh := make(chan []s2.LatLng)
+	sweep, err := job.sweep()
+	if err != nil {
+		return errors.Wrap(err, "invalid sweep")
+	}
 
-	go func() {
-		for i := 0; i < len(origins); i += maxElements {
-			end := i + maxElements
-			if end > len(origins) {
-				end = len(origins)
+	f := &fetcher{
+		provider:   provider,
+		job:        job,
+		sweep:      sweep,
+		checkpoint: checkpoint,
+		err:        &FetchError{},
+		cells:      make(map[s2.LatLng]cell),
+	}
+
+	out, err := NewResultWriter(output)
+	if err != nil {
+		return err
+	}
+
+	err = out.begin(ResultContainer{
+		Version:   ResultVersion,
+		Metadata:  &Metadata{Job: job, Definition: job.Definition, FetchedAt: time.Now()},
+		AreaStart: job.AreaStart,
+		AreaEnd:   job.AreaEnd,
+		Direction: job.Direction,
+		Area:      job.Area,
+	})
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	// results are final once fetched unless they are merged, refined or retried afterwards
+	if out.streaming() && len(sweep) == 1 && job.AdaptiveThreshold == 0 && !job.RetryFailed {
+		f.stream = out
+	}
+
+	results := f.fetch(cells)
+	if job.AdaptiveThreshold > 0 {
+		results = f.refine(cells, results)
+	}
+	if job.RetryFailed {
+		results = f.retryFailed(results)
+	}
+
+	err = out.add(results...)
+	if err == nil {
+		err = f.streamErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to write results")
+	}
+
+	if len(f.err.Failures) > 0 {
+		return f.err
+	}
+	if f.checkpointErr != nil {
+		return errors.Wrap(f.checkpointErr, "results are output, but some batches are missing from the checkpoint")
+	}
+
+	return nil
+}
+
+type fetcher struct {
+	provider   TravelTimeProvider
+	job        FetchJob
+	sweep      []Options
+	checkpoint *Checkpoint
+	err        *FetchError
+	// elements is the number of elements fetched so far.
+	elements int
+	// cells are the fetched cells by their centers.
+	cells map[s2.LatLng]cell
+	// stream, if set, gets the results as soon as they are fetched instead of them being returned.
+	stream    *ResultWriter
+	streamErr error
+	// checkpointErr is the first error of appending a fetched batch to the checkpoint.
+	checkpointErr error
+}
+
+// collect appends the fetched results to the returned ones or writes them to the stream.
+func (f *fetcher) collect(results []Result, fetched []Result) []Result {
+	if f.stream == nil {
+		return append(results, fetched...)
+	}
+
+	if err := f.stream.add(fetched...); err != nil && f.streamErr == nil {
+		f.streamErr = err
+	}
+
+	return results
+}
+
+// fetch fetches travel times between the cells and the destinations at every sampled time.
+func (f *fetcher) fetch(cells []cell) []Result {
+	centers := make([]s2.LatLng, len(cells))
+	for i, c := range cells {
+		centers[i] = c.center()
+	}
+
+	f.err.Total += len(cells) * len(f.job.Destinations) * len(f.sweep)
+
+	return f.fetchAt(cells, centers, f.checkpoint)
+}
+
+// fetchAt fetches travel times of the cells using points[i] as the origin of cells[i].
+func (f *fetcher) fetchAt(cells []cell, points []s2.LatLng, checkpoint *Checkpoint) []Result {
+	index := make(map[s2.LatLng]cell, len(cells))
+	centers := make(map[s2.LatLng]bool, len(cells))
+	for i, c := range cells {
+		index[points[i]] = c
+		centers[c.center()] = true
+		f.cells[c.center()] = c
+	}
+
+	var batches []batch
+	for _, opts := range f.sweep {
+		packed := packBatches(points, f.job.Destinations)
+		if f.job.Direction == DirectionOutbound {
+			packed = packBatches(f.job.Destinations, points)
+		}
+		for _, b := range packed {
+			b.opts = opts
+			batches = append(batches, b)
+		}
+	}
+
+	elements := len(cells) * len(f.job.Destinations) * len(f.sweep)
+	f.elements += elements
+
+	var results []Result
+
+	if checkpoint != nil {
+		for _, r := range checkpoint.Results() {
+			if centers[r.Center] {
+				results = f.collect(results, []Result{r})
 			}
+		}
 
-			originsCh <- origins[i:end]
+		var pending []batch
+		for _, b := range batches {
+			if b = checkpoint.pending(b); len(b.origins) > 0 {
+				pending = append(pending, b)
+			}
 		}
+		glog.Infof("%d/%d batches restored from checkpoint", len(batches)-len(pending), len(batches))
+		batches = pending
+	}
 
-		close(originsCh)
+	resultsCh := make(chan batchResult)
+	batchesCh := make(chan batch)
+
+	go func() {
+		for _, b := range batches {
+			batchesCh <- b
+		}
+
+		close(batchesCh)
 	}()
 
 	for i := 0; i < workers; i++ {
 		go func() {
-			client, err := maps.NewClient(maps.WithAPIKey(apiKey))
-			if err != nil {
-				glog.Fatalf("failed to create client: %v", err)
-			}
-
-			for origins := range originsCh {
-				results, err := getResults(client, origins, dest, opts, stepLat, stepLon)
-				if err != nil {
-					glog.Fatalf("failed to get results: %v", err)
+			for b := range batchesCh {
+				results, err := getResults(f.provider, b, f.job.Direction, index)
+				var checkpointErr error
+				if err == nil && checkpoint != nil {
+					checkpointErr = checkpoint.Append(b, results)
 				}
 
-				resultsCh <- results
+				resultsCh <- batchResult{batch: b, results: results, err: err, checkpointErr: checkpointErr}
 			}
 		}()
 	}
 
-	container := ResultContainer{AreaStart: areaStart, AreaEnd: areaEnd}
-	for i := 0; i < len(origins); i += maxElements {
-		container.Results = append(container.Results, (<-resultsCh)...)
-		glog.Infof("%d/%d origins fetched", i, len(origins))
-	}
+	for i := range batches {
+		done := <-resultsCh
+		if done.err != nil {
+			glog.Errorf("Failed to fetch batch of %dx%d elements: %v", len(done.origins), len(done.destinations), done.err)
+			// the cells are output as failed, so that they can be retried
+			failed := failedResults(done.batch, f.job.Direction, index)
+			failure := BatchFailure{
+				Origins:      done.origins,
+				Destinations: done.destinations,
+				Class:        ClassifyError(done.err),
+				Err:          done.err,
+			}
+			for _, r := range failed {
+				failure.cells = append(failure.cells, r.key())
+			}
+			f.err.Failures = append(f.err.Failures, failure)
+			results = f.collect(results, failed)
+			continue
+		}
 
-	data, err := json.Marshal(container)
-	if err != nil {
-		return errors.Wrap(err, "faled to marshal json")
+		if done.checkpointErr != nil {
+			glog.Errorf("Failed to checkpoint batch of %dx%d elements: %v", len(done.origins), len(done.destinations), done.checkpointErr)
+			if f.checkpointErr == nil {
+				f.checkpointErr = done.checkpointErr
+			}
+		}
+
+		results = f.collect(results, done.results)
+		glog.Infof("%d/%d batches fetched", i+1, len(batches))
 	}
 
-	fmt.Printf("\n\n\n%s\n\n", data)
+	if len(f.sweep) > 1 {
+		results = mergeSamples(results)
+	}
 
-	return nil
+	return results
 }
 
-func RenderKml(jsonFile string, maxDuration time.Duration, grades int) error {
-	data, err := ioutil.ReadFile(jsonFile)
+// RenderKml renders the results file. For sampled results the statistic of the samples is rendered.
+// The KML is written to the output file, gzipped if its name ends with ".gz", or to stdout if it is empty.
+func RenderKml(jsonFile, output string, maxDuration time.Duration, grades int, statistic Statistic) error {
+	container, err := ReadResults(jsonFile)
 	if err != nil {
 		return errors.Wrap(err, fmt.Sprintf("faled to read file %q", jsonFile))
 	}
 
-	var container ResultContainer
+	for i, r := range container.Results {
+		if len(r.Samples) == 0 && r.Unreachable == 0 {
+			continue
+		}
 
-	err = json.Unmarshal(data, &container)
-	if err != nil {
-		return errors.Wrap(err, "faled to unmarshal json")
+		d, ok := r.statistic(statistic)
+		switch {
+		case ok:
+			container.Results[i].Status, container.Results[i].Duration = StatusOK, d
+		case r.ok():
+			// the statistic falls on the times the cell is unreachable at
+			container.Results[i].Status, container.Results[i].Duration = StatusZeroResults, 0
+		}
 	}
 
-	renderedKml, err := getKml(container.Results, container.AreaStart, container.AreaEnd, maxDuration, grades)
+	renderedKml, err := getKml(container, maxDuration, grades, statistic)
 	if err != nil {
 		return errors.Wrap(err, "faled to get KML")
 	}
 
-	fmt.Printf("\n\n\n%s\n\n", renderedKml)
-
-	return nil
-}
+	out, err := createOutput(output)
+	if err != nil {
+		return err
+	}
 
-func getResults(client *maps.Client, origins []s2.LatLng, dest s2.LatLng, opts Options, stepLat, stepLon s1.Angle) ([]Result, error) {
-	r := &maps.DistanceMatrixRequest{
-		Destinations: []string{latLonToSt5ring(dest)},
+	_, err = out.Write(renderedKml)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to write KML")
 	}
 
-	opts.Apply(r)
+	return nil
+}
 
-	for _, ll := range origins {
-		r.Origins = append(r.Origins, latLonToSt5ring(ll))
-	}
+func getResults(provider TravelTimeProvider, b batch, direction Direction, cells map[s2.LatLng]cell) ([]Result, error) {
+	origins, dests := b.origins, b.destinations
 
-	resp, err := client.DistanceMatrix(context.Background(), r)
-	//pretty.Println(resp)
+	matrix, err := provider.TravelTimes(context.Background(), origins, dests, b.opts)
 	if err != nil {
-		return nil, errors.Wrap(err, "faled to process request")
+		return nil, errors.Wrap(err, "failed to get travel times")
 	}
 
-	if len(origins) != len(resp.Rows) {
-		return nil, fmt.Errorf("len(origins) != len(resp.Rows): %d != %d ", len(origins), len(resp.Rows))
+	if len(origins) != len(matrix) {
+		return nil, fmt.Errorf("len(origins) != len(matrix): %d != %d ", len(origins), len(matrix))
 	}
 
 	var results []Result
 
-	for i, row := range resp.Rows {
-		if len(row.Elements) != 1 {
-			glog.Warning("Row elements != 1: ", pretty.Sprint(row))
-			continue
-		}
-		if row.Elements[0].Status != "OK" {
-			glog.Warning("Row status != OK: ", pretty.Sprint(row))
+	for i, row := range matrix {
+		if len(row) != len(dests) {
+			// the cells of the row are output as failed, so that they can be retried
+			glog.Warningf("Row elements != %d: %s", len(dests), pretty.Sprint(row))
+			for j := range dests {
+				point, dest := origins[i], dests[j]
+				if direction == DirectionOutbound {
+					point, dest = dests[j], origins[i]
+				}
+				results = append(results, cellResult(cells[point], dest, StatusError))
+			}
 			continue
 		}
 
-		duration := row.Elements[0].Duration
-		if row.Elements[0].DurationInTraffic > 0 {
-			duration = row.Elements[0].DurationInTraffic
-		}
+		for j, element := range row {
+			point, dest := origins[i], dests[j]
+			if direction == DirectionOutbound {
+				point, dest = dests[j], origins[i]
+			}
 
-		a, c := getOriginBounds(origins[i], stepLat, stepLon)
-		result := Result{
-			Center:   origins[i],
-			A:        a,
-			C:        c,
-			Duration: duration,
-		}
+			result := cellResult(cells[point], dest, element.Status)
 
-		results = append(results, result)
+			cellAddress, destAddress := element.OriginAddress, element.DestinationAddress
+			if direction == DirectionOutbound {
+				cellAddress, destAddress = destAddress, cellAddress
+			}
+			result.CellAddress, result.DestinationAddress = cellAddress, destAddress
+
+			if element.Status == StatusOK {
+				result.Duration = element.Duration
+				result.BaseDuration = element.BaseDuration
+				result.DurationInTraffic = element.DurationInTraffic
+				result.Distance = element.Distance
+			} else {
+				glog.Warning("Element status != OK: ", pretty.Sprint(element))
+			}
+
+			results = append(results, result)
+		}
 	}
 
 	return results, nil
 }
 
-func getKml(results []Result, areaStart, areaEnd s2.LatLng, maxDuration time.Duration, grades int) ([]byte, error) {
+// cellResult returns the result of the cell without a travel time.
+func cellResult(cell cell, dest s2.LatLng, status string) Result {
+	a, c := cell.bounds()
+
+	return Result{
+		Center:      cell.center(),
+		A:           a,
+		C:           c,
+		Status:      status,
+		Destination: dest,
+		CellID:      cell.id(),
+		Vertices:    cell.vertices(),
+	}
+}
+
+// failedResults returns the results of a batch that failed, with StatusError.
+func failedResults(b batch, direction Direction, cells map[s2.LatLng]cell) []Result {
+	var results []Result
+	for _, origin := range b.origins {
+		for _, dest := range b.destinations {
+			point := origin
+			if direction == DirectionOutbound {
+				point, dest = dest, origin
+			}
+			results = append(results, cellResult(cells[point], dest, StatusError))
+		}
+	}
+
+	return results
+}
+
+func getKml(container *ResultContainer, maxDuration time.Duration, grades int, statistic Statistic) ([]byte, error) {
 	grades = 6
 	styles := []*kml.SharedElement{
 		kml.SharedStyle("zone-denied", kml.PolyStyle(kml.Color(color.RGBA{})), kml.LineStyle(kml.Width(0))),
@@ -178,32 +543,72 @@ func getKml(results []Result, areaStart, areaEnd s2.LatLng, maxDuration time.Dur
 		kml.SharedStyle("zone-3", kml.PolyStyle(kml.Color(color.RGBA{A: 0x70, R: 0xFF, G: 0xAA})), kml.LineStyle(kml.Width(0))),
 		kml.SharedStyle("zone-4", kml.PolyStyle(kml.Color(color.RGBA{A: 0x70, R: 0xFF, G: 0x55})), kml.LineStyle(kml.Width(0))),
 		kml.SharedStyle("zone-5", kml.PolyStyle(kml.Color(color.RGBA{A: 0x70, R: 0xFF, G: 0x00})), kml.LineStyle(kml.Width(0))),
+		kml.SharedStyle("zone-unreachable", kml.PolyStyle(kml.Color(color.RGBA{A: 0x70, R: 0x60, G: 0x60, B: 0x60})), kml.LineStyle(kml.Width(0))),
 	}
 
-	document := kml.Document()
+	document := kml.Document(
+		kml.Name(container.Metadata.title()),
+		kml.Description(container.Metadata.description(statistic)),
+	)
 	for _, v := range styles {
 		document.Add(v)
 	}
 
+	document.Add(getLegend(maxDuration, grades))
+
 	// add boundaries
-	folder := kml.Folder(
+	boundaries := getPoly(container.AreaStart, container.AreaEnd)
+	if container.Area != nil {
+		boundaries = container.Area.kml()
+	}
+	document.Add(
 		kml.Placemark(
 			kml.Style(kml.PolyStyle(kml.Color(color.RGBA{}))),
-			getPoly(areaStart, areaEnd),
+			boundaries,
 		),
 	)
 
-	for _, result := range results {
+	// add a layer per destination
+	var dests []s2.LatLng
+	folders := make(map[s2.LatLng]*kml.CompoundElement)
+	for _, result := range container.Results {
+		folder, ok := folders[result.Destination]
+		if !ok {
+			folder = kml.Folder(kml.Name("Results"))
+			if result.Destination != (s2.LatLng{}) {
+				folder = kml.Folder(kml.Name(fmt.Sprintf("To %s", latLonToString(result.Destination))))
+				folder.Add(kml.Placemark(
+					kml.Name("Destination"),
+					kml.Point(kml.Coordinates(kml.Coordinate{Lat: result.Destination.Lat.Degrees(), Lon: result.Destination.Lng.Degrees()})),
+				))
+			}
+			folders[result.Destination] = folder
+			dests = append(dests, result.Destination)
+		}
+
+		if !result.ok() {
+			folder.Add(
+				kml.Placemark(
+					kml.Name(result.Status),
+					kml.StyleURL("#zone-unreachable"),
+					getResultPoly(result),
+				),
+			)
+			continue
+		}
+
 		folder.Add(
 			kml.Placemark(
-				kml.Name(fmt.Sprintf(fmt.Sprintf("%.0f min", result.Duration.Minutes()))),
+				kml.Name(fmt.Sprintf("%.0f min", result.Duration.Minutes())),
 				kml.StyleURL(getStyleId(result.Duration, maxDuration, grades)),
-				getPoly(result.A, result.C),
+				getResultPoly(result),
 			),
 		)
 	}
 
-	document.Add(folder)
+	for _, dest := range dests {
+		document.Add(folders[dest])
+	}
 
 	buf := new(bytes.Buffer)
 	err := kml.KML(document).WriteIndent(buf, " ", " ")
@@ -214,6 +619,22 @@ func getKml(results []Result, areaStart, areaEnd s2.LatLng, maxDuration time.Dur
 	return buf.Bytes(), nil
 }
 
+// getLegend returns a folder with an entry per style, so that map viewers list what the colors mean.
+func getLegend(maxDuration time.Duration, grades int) *kml.CompoundElement {
+	legend := kml.Folder(kml.Name("Legend"))
+
+	for grade := 0; grade < grades; grade++ {
+		legend.Add(kml.Placemark(
+			kml.Name(fmt.Sprintf("%.0f-%.0f min", maxDuration.Minutes()*float64(grade)/float64(grades), maxDuration.Minutes()*float64(grade+1)/float64(grades))),
+			kml.StyleURL(fmt.Sprintf("#zone-%d", grade)),
+		))
+	}
+	legend.Add(kml.Placemark(kml.Name(fmt.Sprintf("over %.0f min", maxDuration.Minutes())), kml.StyleURL("#zone-denied")))
+	legend.Add(kml.Placemark(kml.Name("unreachable"), kml.StyleURL("#zone-unreachable")))
+
+	return legend
+}
+
 func getStyleId(duration, maxDuration time.Duration, grades int) string {
 	if duration > maxDuration {
 		return "#zone-denied"
@@ -227,6 +648,24 @@ func getOriginBounds(origin s2.LatLng, stepLat, stepLon s1.Angle) (a, c s2.LatLn
 		s2.LatLng{Lat: origin.Lat - stepLat/2, Lng: origin.Lng + stepLon/2}
 }
 
+// getResultPoly returns the outline of the result cell.
+func getResultPoly(result Result) *kml.CompoundElement {
+	if len(result.Vertices) == 0 {
+		return getPoly(result.A, result.C)
+	}
+
+	coordinates := make([]kml.Coordinate, len(result.Vertices))
+	for i, v := range result.Vertices {
+		coordinates[i] = kml.Coordinate{Lat: v.Lat.Degrees(), Lon: v.Lng.Degrees()}
+	}
+
+	return kml.Polygon(
+		kml.Extrude(true),
+		kml.AltitudeMode("relativeToGround"),
+		kml.OuterBoundaryIs(kml.LinearRing(kml.Coordinates(coordinates...))),
+	)
+}
+
 func getPoly(a, c s2.LatLng) *kml.CompoundElement {
 	poly := kml.Polygon(
 		kml.Extrude(true),
@@ -246,7 +685,44 @@ func getPoly(a, c s2.LatLng) *kml.CompoundElement {
 	return poly
 }
 
-func getLatLngsInRect(rectStart, rectEnd s2.LatLng, stepLat, stepLon s1.Angle) (origins []s2.LatLng, err error) {
+// getGrid returns the origins spaced stepMeters apart in the area and the angular steps between them.
+func getGrid(dest, areaStart, areaEnd s2.LatLng, stepMeters int) (origins []s2.LatLng, stepLat, stepLon s1.Angle, err error) {
+	if stepMeters <= 0 {
+		return nil, 0, 0, fmt.Errorf("invalid step %d", stepMeters)
+	}
+
+	stepLat, stepLon = getSteps(dest, stepMeters)
+	origins, err = getLatLngsInRect(areaStart, areaEnd, stepLat, stepLon)
+
+	return origins, stepLat, stepLon, err
+}
+
+// getGridSize returns the number of origins getGrid yields, without allocating them.
+func getGridSize(dest, areaStart, areaEnd s2.LatLng, stepMeters int) (int, error) {
+	if stepMeters <= 0 {
+		return 0, fmt.Errorf("invalid step %d", stepMeters)
+	}
+
+	stepLat, stepLon := getSteps(dest, stepMeters)
+	rectStart, rectEnd := sortRectCorners(areaStart, areaEnd)
+
+	var rows, columns int
+	for lat := rectStart.Lat; lat < rectEnd.Lat; lat += stepLat {
+		rows++
+	}
+	for lon := rectStart.Lng; lon < rectEnd.Lng; lon += stepLon {
+		columns++
+	}
+
+	return rows * columns, nil
+}
+
+func getSteps(dest s2.LatLng, stepMeters int) (stepLat, stepLon s1.Angle) {
+	return s1.Angle(float64(stepMeters) / earthRadius),
+		s1.Angle(float64(stepMeters) / (earthRadius * math.Cos(float64(dest.Lat))))
+}
+
+func sortRectCorners(rectStart, rectEnd s2.LatLng) (s2.LatLng, s2.LatLng) {
 	if rectEnd.Lat < rectStart.Lat {
 		rectEnd.Lat, rectStart.Lat = rectStart.Lat, rectEnd.Lat
 	}
@@ -254,6 +730,12 @@ func getLatLngsInRect(rectStart, rectEnd s2.LatLng, stepLat, stepLon s1.Angle) (
 		rectEnd.Lng, rectStart.Lng = rectStart.Lng, rectEnd.Lng
 	}
 
+	return rectStart, rectEnd
+}
+
+func getLatLngsInRect(rectStart, rectEnd s2.LatLng, stepLat, stepLon s1.Angle) (origins []s2.LatLng, err error) {
+	rectStart, rectEnd = sortRectCorners(rectStart, rectEnd)
+
 	for lat := rectStart.Lat; lat < rectEnd.Lat; lat += stepLat {
 		for lon := rectStart.Lng; lon < rectEnd.Lng; lon += stepLon {
 			origins = append(origins, s2.LatLng{Lat: lat, Lng: lon})
@@ -263,6 +745,6 @@ func getLatLngsInRect(rectStart, rectEnd s2.LatLng, stepLat, stepLon s1.Angle) (
 	return
 }
 
-func latLonToSt5ring(ll s2.LatLng) string {
+func latLonToString(ll s2.LatLng) string {
 	return fmt.Sprintf("%.6f,%.6f", ll.Lat.Degrees(), ll.Lng.Degrees())
 }
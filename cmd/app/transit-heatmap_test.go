@@ -0,0 +1,175 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"github.com/golang/geo/s2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeProvider answers with travelTimes, counting the calls.
+type fakeProvider struct {
+	mu          sync.Mutex
+	calls       int
+	travelTimes func(call int, origins, destinations []s2.LatLng) ([][]TravelTime, error)
+}
+
+func (p *fakeProvider) TravelTimes(ctx context.Context, origins, destinations []s2.LatLng, opts Options) ([][]TravelTime, error) {
+	p.mu.Lock()
+	p.calls++
+	call := p.calls
+	p.mu.Unlock()
+
+	return p.travelTimes(call, origins, destinations)
+}
+
+// okMatrix returns a travel time of 10 minutes for every pair.
+func okMatrix(origins, destinations []s2.LatLng) [][]TravelTime {
+	matrix := make([][]TravelTime, len(origins))
+	for i := range matrix {
+		for range destinations {
+			matrix[i] = append(matrix[i], TravelTime{Status: StatusOK, Duration: 10 * time.Minute})
+		}
+	}
+	return matrix
+}
+
+// testJob is a job of the 2x2 cells of the cassette area.
+func testJob() FetchJob {
+	return FetchJob{
+		Destinations: []s2.LatLng{s2.LatLngFromDegrees(55.801, 37.601)},
+		AreaStart:    s2.LatLngFromDegrees(55.69, 37.59),
+		AreaEnd:      s2.LatLngFromDegrees(55.705, 37.615),
+		StepMeters:   1000,
+		Options:      Options{Mode: "transit"},
+	}
+}
+
+// fetchTestResults fetches the job from the provider and returns the output along with the error of FetchResults.
+func fetchTestResults(t *testing.T, provider TravelTimeProvider, job FetchJob) ([]Result, error) {
+	dir, err := ioutil.TempDir("", "fetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	output := filepath.Join(dir, "results.json")
+	fetchErr := FetchResults(provider, job, nil, output)
+
+	container, err := ReadResults(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return container.Results, fetchErr
+}
+
+// TestShortRowFails checks that the cells of a row missing elements are output as failed.
+func TestShortRowFails(t *testing.T) {
+	provider := &fakeProvider{travelTimes: func(call int, origins, destinations []s2.LatLng) ([][]TravelTime, error) {
+		matrix := okMatrix(origins, destinations)
+		matrix[0] = nil
+		return matrix, nil
+	}}
+
+	results, _ := fetchTestResults(t, provider, testJob())
+
+	statuses := make(map[string]int)
+	for _, r := range results {
+		statuses[r.Status]++
+	}
+	if len(results) != 4 || statuses[StatusError] != 1 || statuses[StatusOK] != 3 {
+		t.Errorf("got %d results with statuses %v, want 1 ERROR and 3 OK", len(results), statuses)
+	}
+}
+
+// TestCheckpointWriteFailure checks that results fetched are output even if the checkpoint can't be written.
+func TestCheckpointWriteFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	job := testJob()
+	checkpoint, err := OpenCheckpoint(filepath.Join(dir, "checkpoint.ndjson"), job, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// appending to a closed file fails
+	checkpoint.Close()
+
+	provider := &fakeProvider{travelTimes: func(call int, origins, destinations []s2.LatLng) ([][]TravelTime, error) {
+		return okMatrix(origins, destinations), nil
+	}}
+
+	output := filepath.Join(dir, "results.json")
+	if err := FetchResults(provider, job, checkpoint, output); err == nil {
+		t.Error("got no error of the checkpoint")
+	} else if _, ok := err.(*FetchError); ok {
+		t.Errorf("got %v, want an error of the checkpoint", err)
+	}
+
+	container, err := ReadResults(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range container.Results {
+		if r.Status != StatusOK {
+			t.Errorf("got status %s of %v, want OK", r.Status, r.Center)
+		}
+	}
+	if len(container.Results) != 4 {
+		t.Errorf("got %d results, want 4", len(container.Results))
+	}
+}
+
+// TestRetryRecoversFailure checks that a batch failing once and succeeding on retry isn't reported as failed.
+func TestRetryRecoversFailure(t *testing.T) {
+	provider := &fakeProvider{travelTimes: func(call int, origins, destinations []s2.LatLng) ([][]TravelTime, error) {
+		if call == 1 {
+			return nil, &ProviderError{Class: ErrorTransient, Err: errors.New("backend error")}
+		}
+		return okMatrix(origins, destinations), nil
+	}}
+
+	job := testJob()
+	job.RetryFailed = true
+
+	results, err := fetchTestResults(t, provider, job)
+	if err != nil {
+		t.Errorf("got %v, want no error", err)
+	}
+	if provider.calls != 2 {
+		t.Errorf("got %d calls, want 2", provider.calls)
+	}
+	for _, r := range results {
+		if r.Status != StatusOK {
+			t.Errorf("got status %s of %v, want OK", r.Status, r.Center)
+		}
+	}
+}
+
+// TestRetryKeepsFailure checks that a batch failing on retry too is reported once, counting its elements once.
+func TestRetryKeepsFailure(t *testing.T) {
+	provider := &fakeProvider{travelTimes: func(call int, origins, destinations []s2.LatLng) ([][]TravelTime, error) {
+		return nil, &ProviderError{Class: ErrorTransient, Err: errors.New("backend error")}
+	}}
+
+	job := testJob()
+	job.RetryFailed = true
+
+	_, err := fetchTestResults(t, provider, job)
+	fetchErr, ok := err.(*FetchError)
+	if !ok {
+		t.Fatalf("got %v, want *FetchError", err)
+	}
+	if fetchErr.Total != 4 || len(fetchErr.Failures) != 1 {
+		t.Errorf("got %d failures of %d elements, want 1 of 4", len(fetchErr.Failures), fetchErr.Total)
+	}
+}
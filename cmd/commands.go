@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"github.com/mshaverdo/transitcalc/cmd/app"
+	"time"
+)
+
+func renderCommand(fs *flag.FlagSet) func() {
+	var output string
+	var maxDurationMins = 30
+	var statisticStr = string(app.StatisticMedian)
+
+	fs.StringVar(&output, "o", "", "output KML file, stdout if empty, *.gz files are gzipped")
+	fs.IntVar(&maxDurationMins, "max_duration", maxDurationMins, "max duration in minutes, longer travel times aren't colored")
+	fs.IntVar(&maxDurationMins, "max_duratoin", maxDurationMins, "deprecated, use -max_duration")
+	fs.StringVar(&statisticStr, "statistic", statisticStr, "statistic of sampled travel times to render: median, min, max, worst or a percentile like p10, p90")
+
+	return func() {
+		if fs.NArg() != 1 {
+			usageFatal(fs, "No datafile specified")
+		}
+
+		statistic, err := app.ParseStatistic(statisticStr)
+		CheckErr(err, "Invalid statistic")
+
+		err = app.RenderKml(
+			fs.Arg(0),
+			output,
+			time.Duration(maxDurationMins)*time.Minute,
+			3,
+			statistic,
+		)
+		CheckErr(err, "Failed to render KML")
+	}
+}
+
+func diffCommand(fs *flag.FlagSet) func() {
+	var output string
+
+	fs.StringVar(&output, "o", "", "output CSV file, stdout if empty, *.gz files are gzipped")
+
+	return func() {
+		if fs.NArg() != 2 {
+			usageFatal(fs, "Two datafiles expected")
+		}
+
+		err := app.DiffResults(fs.Arg(0), fs.Arg(1), output)
+		CheckErr(err, "Failed to diff results")
+	}
+}
+
+func statsCommand(fs *flag.FlagSet) func() {
+	var output string
+	var maxDurationMins = 30
+
+	fs.StringVar(&output, "o", "", "output file, stdout if empty")
+	fs.IntVar(&maxDurationMins, "max_duration", maxDurationMins, "count cells within the duration in minutes")
+	fs.IntVar(&maxDurationMins, "max_duratoin", maxDurationMins, "deprecated, use -max_duration")
+
+	return func() {
+		if fs.NArg() != 1 {
+			usageFatal(fs, "No datafile specified")
+		}
+
+		err := app.WriteStats(fs.Arg(0), output, time.Duration(maxDurationMins)*time.Minute)
+		CheckErr(err, "Failed to get stats")
+	}
+}
+
+func mergeCommand(fs *flag.FlagSet) func() {
+	var output string
+
+	fs.StringVar(&output, "o", "", "output file, stdout if empty; *.ndjson files are written as NDJSON, *.gz files are gzipped")
+
+	return func() {
+		if fs.NArg() == 0 {
+			usageFatal(fs, "No datafiles specified")
+		}
+
+		err := app.MergeResults(fs.Args(), output)
+		CheckErr(err, "Failed to merge results")
+	}
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/golang/geo/s2"
+	"github.com/golang/glog"
+	"github.com/mshaverdo/transitcalc/cmd/app"
+	"github.com/pkg/errors"
+	"googlemaps.github.io/maps"
+	"math"
+	"os"
+	"time"
+)
+
+// runFlags are the fetch flags that aren't a part of the job definition: the API key and the state of the run.
+type runFlags struct {
+	apiKey                                 string
+	checkpointFile, recordFile, replayFile string
+	resume, overwriteCheckpoint, dryRun    bool
+}
+
+func (r *runFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&r.apiKey, "key", "", "distance matrix google API key")
+	fs.BoolVar(&r.dryRun, "dry_run", false, "print the number of origins, elements, requests and the estimated cost without fetching")
+
+	fs.StringVar(&r.checkpointFile, "checkpoint", "", "append fetched batches to a checkpoint file")
+	fs.BoolVar(&r.resume, "resume", false, "resume the fetch from the checkpoint file, skipping fetched origins")
+	fs.BoolVar(&r.overwriteCheckpoint, "overwrite_checkpoint", false, "overwrite the batches of the checkpoint file instead of refusing to start")
+
+	fs.StringVar(&r.recordFile, "record", "", "record google API traffic to a cassette file")
+	fs.StringVar(&r.replayFile, "replay", "", "replay google API traffic from a cassette file instead of calling the API, older cassettes need -timezone")
+}
+
+// defaultJobFile returns the job with the defaults of the fetch flags.
+func defaultJobFile() app.JobFile {
+	return app.JobFile{
+		Direction:       string(app.DirectionInbound),
+		Grid:            string(app.GridSquare),
+		StepMeters:      500,
+		MinStepMeters:   50,
+		PricePerElement: app.DefaultPricePerElement,
+		Provider:        "google",
+		WalkingSpeed:    app.DefaultWalkingModel.Speed,
+		MaxWalk:         app.DefaultWalkingModel.MaxAccessDistance,
+		MaxTransferWalk: app.DefaultWalkingModel.MaxTransferDistance,
+		MaxTransfers:    3,
+		MaxAttempts:     app.DefaultRetryPolicy.MaxAttempts,
+		QuotaPause:      app.DefaultRetryPolicy.QuotaPause,
+		CacheTTL:        30 * 24 * time.Hour,
+		MaxDuration:     30,
+		Statistic:       string(app.StatisticMedian),
+	}
+}
+
+func fetchCommand(fs *flag.FlagSet) func() {
+	job := defaultJobFile()
+	var run runFlags
+
+	run.register(fs)
+
+	fs.StringVar(&job.Output, "o", "", "output file, stdout if empty; results are streamed as NDJSON to *.ndjson files, *.gz files are gzipped")
+	fs.StringVar(&job.Kml, "kml", "", "render the output file to a KML file after the fetch")
+	fs.IntVar(&job.MaxDuration, "max_duration", job.MaxDuration, "max duration in minutes of the KML, longer travel times aren't colored")
+	fs.IntVar(&job.MaxDuration, "max_duratoin", job.MaxDuration, "deprecated, use -max_duration")
+	fs.StringVar(&job.Statistic, "statistic", job.Statistic, "statistic of sampled travel times to render to the KML")
+
+	fs.Var((*stringList)(&job.Destinations), "dst", "destination, may be repeated: lat,lng in decimal degrees or DMS, geohash:<hash>, a full plus code or an address")
+	fs.StringVar(&job.DestinationFile, "dst_file", "", "file with destination points or addresses, one per line")
+	fs.IntVar(&job.StepMeters, "step", job.StepMeters, "step in meters")
+	fs.StringVar(&job.Gazetteer, "gazetteer", "", "CSV file of place names with their coords to resolve addresses instead of Google geocoding")
+	fs.StringVar(&job.Area, "area", "", "KML or GeoJSON file with the polygons of the area, instead of the corner points")
+	fs.StringVar(&job.Grid, "grid", job.Grid, "grid of sampled cells: square, hex or s2")
+	fs.IntVar(&job.S2Level, "s2_level", 0, "level of the s2 grid cells, 0 picks the level closest to step")
+	fs.DurationVar(&job.SweepWindow, "sweep_window", 0, "sample travel times within the window starting at departure_time or arrival_time")
+	fs.DurationVar(&job.SweepStep, "sweep_step", 0, "interval between sampled travel times within sweep_window")
+	fs.DurationVar(&job.AdaptiveThreshold, "adaptive_threshold", 0, "subdivide cells whose travel time differs from a neighbouring cell by more than the threshold")
+	fs.IntVar(&job.MinStepMeters, "min_step", job.MinStepMeters, "min step in meters of adaptive refinement")
+	fs.StringVar(&job.Direction, "direction", job.Direction, "inbound measures travel from the area to dst, outbound from dst to the area")
+
+	fs.StringVar(&job.Provider, "provider", job.Provider, "travel time provider: google or gtfs")
+	fs.StringVar(&job.Gtfs, "gtfs", "", "GTFS feed zip for the gtfs provider")
+	fs.Float64Var(&job.WalkingSpeed, "walking_speed", job.WalkingSpeed, "walking speed in m/s for the gtfs provider")
+	fs.Float64Var(&job.MaxWalk, "max_walk", job.MaxWalk, "max walk in meters to and from stops for the gtfs provider")
+	fs.Float64Var(&job.MaxTransferWalk, "max_transfer_walk", job.MaxTransferWalk, "max walk in meters between stops for the gtfs provider")
+	fs.IntVar(&job.MaxTransfers, "max_transfers", job.MaxTransfers, "max transfers for the gtfs provider")
+
+	fs.StringVar(&job.Budget, "budget", "", "pick the finest step that fits the element count, e.g. 10000, or the money limit in USD, e.g. $50")
+	fs.Float64Var(&job.PricePerElement, "price_per_element", job.PricePerElement, "price of a Distance Matrix element in USD")
+
+	fs.StringVar(&job.Cache, "cache", "", "cache travel times in a file and request only uncached origins")
+	fs.DurationVar(&job.CacheTTL, "cache_ttl", job.CacheTTL, "max age of cached travel times, 0 means forever")
+
+	fs.BoolVar(&job.RetryFailed, "retry_failed", false, "re-query cells without a travel time after the fetch")
+	fs.IntVar(&job.RetryNudgeMeters, "retry_nudge", 0, "move the origins of retried cells that many meters north, east, south and west in turn")
+	fs.IntVar(&job.MaxAttempts, "max_attempts", job.MaxAttempts, "max attempts of a request on transient and quota errors")
+	fs.DurationVar(&job.QuotaPause, "quota_pause", job.QuotaPause, "pause after a quota error")
+
+	fs.StringVar(&job.DepartureTime, "departure_time", "", "The desired time of departure `"+app.TimeLayout+"` or the next typical day like \"Tue 08:30\" or \"weekday 08:30\".")
+	fs.StringVar(&job.ArrivalTime, "arrival_time", "", "Specifies the desired time of arrival `"+app.TimeLayout+"` or the next typical day.")
+	fs.StringVar(&job.Holidays, "holidays", "", "file of holiday dates `2006-01-02`, one per line, skipped by typical days")
+	fs.StringVar(&job.Timezone, "timezone", "", "timezone of departure_time and arrival_time, e.g. Europe/Moscow; the timezone of the dsts by default, "+
+		"looked up in the GTFS feed or with the API key, so needed without them and to replay cassettes recorded without the lookups")
+	fs.StringVar(&job.Mode, "mode", "", "Specifies the mode of transport to use when calculating distance.")
+	fs.StringVar(&job.Language, "language", "", "The language in which to return results.")
+	fs.StringVar(&job.Avoid, "avoid", "", "Introduces restrictions to the route.")
+	fs.StringVar(&job.Units, "units", "", "Specifies the unit system to use when expressing distance as text.")
+	fs.StringVar(&job.TransitPreference, "transit_routing_preference", "", "Specifies preferences for transit requests.")
+	fs.StringVar(&job.TrafficModel, "traffic_model", "", "Specifies the assumptions to use when calculating time in traffic.")
+	fs.StringVar(&job.TransitMode, "transit_mode", "", "Specifies one or more preferred modes of transit.")
+
+	return func() {
+		if job.Area != "" && fs.NArg() != 0 {
+			usageFatal(fs, "Area corners can't be combined with -area")
+		}
+		if job.Area == "" && fs.NArg() != 2 {
+			usageFatal(fs, "No origin area specified")
+		}
+		if len(job.Destinations) == 0 && job.DestinationFile == "" {
+			usageFatal(fs, "No destination specified")
+		}
+		job.Corners = fs.Args()
+
+		CheckErr(runJob(job, run), "Failed to fetch results")
+	}
+}
+
+func runCommand(fs *flag.FlagSet) func() {
+	var run runFlags
+	var output string
+
+	run.register(fs)
+	fs.StringVar(&output, "o", "", "output file instead of the one of the job; the results of a results file go to stdout unless set")
+
+	return func() {
+		if fs.NArg() != 1 {
+			usageFatal(fs, "No job file specified")
+		}
+
+		job := defaultJobFile()
+		err := app.LoadJobFile(fs.Arg(0), &job)
+		CheckErr(err, "Invalid job")
+		if output != "" {
+			job.Output = output
+		}
+
+		CheckErr(runJob(job, run), "Failed to run job")
+	}
+}
+
+// runJob fetches the results of the job and renders them to KML if the job asks for it.
+func runJob(job app.JobFile, run runFlags) error {
+	var err error
+	var opts = app.Options{
+		Mode:                     job.Mode,
+		Language:                 job.Language,
+		Avoid:                    job.Avoid,
+		Units:                    job.Units,
+		TransitMode:              job.TransitMode,
+		TransitRoutingPreference: job.TransitPreference,
+		TrafficModel:             job.TrafficModel,
+	}
+
+	if run.recordFile != "" && run.replayFile != "" {
+		return errors.New("record and replay can't be combined")
+	}
+
+	apiKey := run.apiKey
+	var clientOptions []maps.ClientOption
+	if run.recordFile != "" {
+		recorder, err := app.NewCassetteRecorder(run.recordFile)
+		if err != nil {
+			return errors.Wrap(err, "invalid record cassette")
+		}
+		defer recorder.Close()
+		clientOptions = append(clientOptions, recorder.ClientOption())
+	}
+	if run.replayFile != "" {
+		player, err := app.NewCassettePlayer(run.replayFile)
+		if err != nil {
+			return errors.Wrap(err, "invalid replay cassette")
+		}
+		defer player.Close()
+		clientOptions = append(clientOptions, player.ClientOption())
+		if apiKey == "" {
+			apiKey = "replay"
+		}
+	}
+
+	resolver, err := newPointResolver(job, apiKey, clientOptions)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	var area *app.Area
+	var rectStart, rectEnd s2.LatLng
+	if job.Area != "" {
+		if len(job.Corners) != 0 {
+			return errors.New("area corners can't be combined with an area file")
+		}
+
+		area, err = app.LoadArea(job.Area)
+		if err != nil {
+			return errors.Wrap(err, "invalid area")
+		}
+		rectStart, rectEnd = area.Bounds()
+	} else {
+		if len(job.Corners) != 2 {
+			return errors.New("no origin area specified, two corners or an area file expected")
+		}
+
+		rectStart, err = resolver.Resolve(ctx, job.Corners[0])
+		if err != nil {
+			return errors.Wrap(err, "invalid area corner")
+		}
+		rectEnd, err = resolver.Resolve(ctx, job.Corners[1])
+		if err != nil {
+			return errors.Wrap(err, "invalid area corner")
+		}
+	}
+
+	var dests []s2.LatLng
+	for _, destStr := range job.Destinations {
+		dest, err := resolver.Resolve(ctx, destStr)
+		if err != nil {
+			return errors.Wrap(err, "invalid dst")
+		}
+		dests = append(dests, dest)
+	}
+	if job.DestinationFile != "" {
+		fileDests, err := PointsFromFile(ctx, job.DestinationFile, resolver)
+		if err != nil {
+			return errors.Wrap(err, "invalid dst_file")
+		}
+		dests = append(dests, fileDests...)
+	}
+	if len(dests) == 0 {
+		return errors.New("no destination specified")
+	}
+	job.Geocoded = resolver.Places
+
+	var timezone string
+	if job.ArrivalTime != "" || job.DepartureTime != "" {
+		loc, err := jobLocation(ctx, job, dests, apiKey, clientOptions)
+		if err != nil && run.replayFile != "" {
+			return errors.Wrap(err, "failed to get timezone, cassettes recorded without timezone lookups need -timezone")
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to get timezone")
+		}
+		timezone = loc.String()
+
+		var holidays app.Holidays
+		if job.Holidays != "" {
+			holidays, err = app.LoadHolidays(job.Holidays)
+			if err != nil {
+				return errors.Wrap(err, "invalid holidays")
+			}
+		}
+
+		if job.ArrivalTime != "" {
+			opts.ArrivalTime, err = jobTime(job, job.ArrivalTime, loc, holidays)
+			if err != nil {
+				return errors.Wrap(err, "invalid arrival_time")
+			}
+			glog.Infof("Arrival time %s (%s), %s", opts.ArrivalTime.Format(app.TimeLayout+" MST"), timezone, opts.ArrivalTime.UTC().Format(app.TimeLayout+" MST"))
+		}
+
+		if job.DepartureTime != "" {
+			opts.DepartureTime, err = jobTime(job, job.DepartureTime, loc, holidays)
+			if err != nil {
+				return errors.Wrap(err, "invalid departure_time")
+			}
+			glog.Infof("Departure time %s (%s), %s", opts.DepartureTime.Format(app.TimeLayout+" MST"), timezone, opts.DepartureTime.UTC().Format(app.TimeLayout+" MST"))
+		}
+	}
+
+	// fail before loading the provider, it would reject every request
+	validate := opts.ValidateConflicts
+	if job.Provider == "google" {
+		validate = opts.Validate
+	}
+	if err := validate(); err != nil {
+		return err
+	}
+
+	direction, err := app.ParseDirection(job.Direction)
+	if err != nil {
+		return errors.Wrap(err, "invalid direction")
+	}
+
+	grid, err := app.ParseGrid(job.Grid)
+	if err != nil {
+		return errors.Wrap(err, "invalid grid")
+	}
+
+	var statistic app.Statistic
+	if job.Kml != "" {
+		if job.Output == "" || job.Output == "-" {
+			return errors.New("the KML is rendered from the output file, none specified")
+		}
+		statistic, err = app.ParseStatistic(job.Statistic)
+		if err != nil {
+			return errors.Wrap(err, "invalid statistic")
+		}
+	}
+
+	fetchJob := app.FetchJob{
+		Destinations: dests,
+		AreaStart:    rectStart,
+		AreaEnd:      rectEnd,
+		StepMeters:   job.StepMeters,
+		Grid:         grid,
+		S2Level:      job.S2Level,
+		Area:         area,
+		Provider:     job.Provider,
+		Direction:    direction,
+		Options:      opts,
+		Timezone:     timezone,
+		SweepWindow:  job.SweepWindow,
+		SweepStep:    job.SweepStep,
+
+		AdaptiveThreshold: job.AdaptiveThreshold,
+		MinStepMeters:     job.MinStepMeters,
+
+		RetryFailed:      job.RetryFailed,
+		RetryNudgeMeters: job.RetryNudgeMeters,
+
+		Definition: &job,
+	}
+
+	if job.Budget != "" {
+		budget, err := app.ParseBudget(job.Budget)
+		if err != nil {
+			return errors.Wrap(err, "invalid budget")
+		}
+
+		if job.AdaptiveThreshold > 0 {
+			// the budget limits refinement of the initial grid instead of picking its step
+			fetchJob.MaxElements = budget.Elements
+			if budget.Money > 0 {
+				fetchJob.MaxElements = int(budget.Money / job.PricePerElement)
+			}
+		} else {
+			plan, err := app.PlanFetchWithinBudget(fetchJob, budget, job.PricePerElement)
+			if err != nil {
+				return errors.Wrap(err, "failed to fit budget")
+			}
+			glog.Infof("Step %d m fits the budget %s", plan.StepMeters, job.Budget)
+			fetchJob.StepMeters = plan.StepMeters
+		}
+	}
+
+	if run.dryRun {
+		plan, err := app.PlanFetch(fetchJob, job.PricePerElement)
+		if err != nil {
+			return errors.Wrap(err, "failed to plan fetch")
+		}
+		fmt.Print(plan)
+		return nil
+	}
+
+	var checkpoint *app.Checkpoint
+	if run.checkpointFile != "" {
+		checkpoint, err = app.OpenCheckpoint(run.checkpointFile, fetchJob, run.resume, run.overwriteCheckpoint)
+		if err != nil {
+			return errors.Wrap(err, "invalid checkpoint")
+		}
+		defer checkpoint.Close()
+	} else if run.resume {
+		return errors.New("no checkpoint file specified to resume from")
+	}
+
+	walking := app.WalkingModel{
+		Speed:               job.WalkingSpeed,
+		MaxAccessDistance:   job.MaxWalk,
+		MaxTransferDistance: job.MaxTransferWalk,
+	}
+	provider, err := NewProvider(job.Provider, apiKey, clientOptions, job.Gtfs, walking, job.MaxTransfers)
+	if err != nil {
+		return errors.Wrap(err, "invalid provider")
+	}
+
+	retryPolicy := app.DefaultRetryPolicy
+	retryPolicy.MaxAttempts = job.MaxAttempts
+	retryPolicy.QuotaPause = job.QuotaPause
+	provider = app.NewRetryingProvider(provider, retryPolicy)
+
+	var cache *app.TravelTimeCache
+	if job.Cache != "" {
+		cache, err = app.OpenTravelTimeCache(job.Cache, job.CacheTTL)
+		if err != nil {
+			return errors.Wrap(err, "invalid cache")
+		}
+		defer cache.Close()
+		provider = app.NewCachingProvider(job.Provider, provider, cache)
+	}
+
+	err = app.FetchResults(provider, fetchJob, checkpoint, job.Output)
+
+	if cache != nil {
+		hits, misses := cache.Stats()
+		glog.Infof("Cache hits: %d, misses: %d, hit ratio: %.1f%%", hits, misses, 100*float64(hits)/math.Max(float64(hits+misses), 1))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if job.Kml != "" {
+		return app.RenderKml(job.Output, job.Kml, time.Duration(job.MaxDuration)*time.Minute, 3, statistic)
+	}
+
+	return nil
+}
+
+// jobLocation returns the timezone the times of the job are in: the timezone set by the job or the one of dests,
+// taken from the GTFS feed or the Google Time Zone API. Destinations in different timezones are an error.
+func jobLocation(ctx context.Context, job app.JobFile, dests []s2.LatLng, apiKey string, clientOptions []maps.ClientOption) (*time.Location, error) {
+	if job.Timezone != "" {
+		return time.LoadLocation(job.Timezone)
+	}
+
+	var lookup app.TimezoneLookup
+	switch {
+	case job.Provider == "gtfs":
+		// the feed has a single timezone for all points
+		dests = dests[:1]
+		lookup = app.GtfsTimezoneLookup{Feed: job.Gtfs}
+	case apiKey != "":
+		google, err := app.NewGoogleTimezoneLookup(apiKey, clientOptions...)
+		if err != nil {
+			return nil, err
+		}
+		lookup = google
+	default:
+		return nil, errors.New("the timezone of the destinations is unknown without an API key, set -timezone")
+	}
+
+	// the time in UTC is close enough to pick the daylight saving rules, typical days are soon enough
+	timeStr := job.DepartureTime
+	if timeStr == "" {
+		timeStr = job.ArrivalTime
+	}
+	at, err := time.Parse(app.TimeLayout, timeStr)
+	if err != nil {
+		at = time.Now()
+	}
+
+	var loc *time.Location
+	for _, dest := range dests {
+		l, err := lookup.Timezone(ctx, dest, at)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("failed to get timezone of dst %v", dest))
+		}
+		if loc != nil && l.String() != loc.String() {
+			return nil, fmt.Errorf("destinations are in timezones %s and %s, set -timezone", loc, l)
+		}
+		loc = l
+	}
+
+	return loc, nil
+}
+
+// jobTime parses a departure or arrival time of the job. Google rejects past times,
+// so for it past dates are moved by whole weeks to the future.
+func jobTime(job app.JobFile, s string, loc *time.Location, holidays app.Holidays) (time.Time, error) {
+	now := time.Now()
+	t, err := app.ParseTime(s, loc, now, holidays)
+	if err != nil || job.Provider == "gtfs" || t.After(now) {
+		return t, err
+	}
+
+	next, err := holidays.NextOccurrence(t, now)
+	if err != nil {
+		return t, err
+	}
+	glog.Warningf("Time %s has passed, taking %s instead", t.Format(app.TimeLayout), next.Format(app.TimeLayout))
+
+	return next, nil
+}
+
+// newPointResolver returns the resolver of the job points. Addresses are looked up in the gazetteer of the job
+// or geocoded with Google if there is an API key. Every geocoded address is printed for confirmation.
+func newPointResolver(job app.JobFile, apiKey string, clientOptions []maps.ClientOption) (*app.PointResolver, error) {
+	resolver := &app.PointResolver{
+		Places: job.Geocoded,
+		Confirm: func(place app.GeocodedPlace, matches int) {
+			fmt.Fprintf(os.Stderr, "%q: %s at %s", place.Query, place.Address, place.Point)
+			if matches > 1 {
+				fmt.Fprintf(os.Stderr, ", the best of %d matches", matches)
+			}
+			fmt.Fprintln(os.Stderr)
+		},
+	}
+
+	switch {
+	case job.Gazetteer != "":
+		resolver.Geocoder = &gazetteerFile{path: job.Gazetteer}
+	case apiKey != "":
+		geocoder, err := app.NewGoogleGeocoder(apiKey, job.Language, clientOptions...)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid geocoder")
+		}
+		resolver.Geocoder = geocoder
+	}
+
+	return resolver, nil
+}
+
+// gazetteerFile loads the gazetteer on the first lookup, so jobs with every address geocoded before don't need it.
+type gazetteerFile struct {
+	path      string
+	gazetteer *app.Gazetteer
+}
+
+func (g *gazetteerFile) Geocode(ctx context.Context, address string) ([]app.GeocodedPlace, error) {
+	if g.gazetteer == nil {
+		gazetteer, err := app.LoadGazetteer(g.path)
+		if err != nil {
+			return nil, err
+		}
+		g.gazetteer = gazetteer
+	}
+
+	return g.gazetteer.Geocode(ctx, address)
+}
@@ -1,95 +1,98 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/golang/geo/s2"
 	"github.com/golang/glog"
 	"github.com/mshaverdo/transitcalc/cmd/app"
 	"github.com/pkg/errors"
-	"regexp"
-	"strconv"
-	"time"
+	"googlemaps.github.io/maps"
+	"io/ioutil"
+	"os"
+	"strings"
 )
 
-const (
-	timeLayout = "2006-01-02 15:04"
-)
+// command is a subcommand of the CLI with its own flags.
+type command struct {
+	name string
+	// args is the synopsis of the positional arguments.
+	args        string
+	description string
+	// setup registers the command flags and returns the function running the command.
+	setup func(fs *flag.FlagSet) func()
+}
 
-func main() {
-	var apiKey, destStr, arrTimeStr, depTimeStr string
-	var (
-		maxDurationMins = 30
-		stepMeters      = 500
-	)
-	var opts app.Options
-	var renderKml bool
-
-	flag.BoolVar(&renderKml, "render_kml", false, "render kml")
-
-	flag.StringVar(&apiKey, "key", apiKey, "distance matrix google API key")
-	flag.StringVar(&destStr, "dst", destStr, "destination coords")
-	flag.IntVar(&maxDurationMins, "max_duratoin", maxDurationMins, "dmax duration")
-	flag.IntVar(&stepMeters, "step", stepMeters, "step in meters")
-
-	flag.StringVar(&depTimeStr, "departure_time", "", "The desired time of departure `"+timeLayout+"`.")
-	flag.StringVar(&arrTimeStr, "arrival_time", "", "Specifies the desired time of arrival `"+timeLayout+"`.")
-	flag.StringVar(&opts.Mode, "mode", "", "Specifies the mode of transport to use when calculating distance.")
-	flag.StringVar(&opts.Language, "language", "", "The language in which to return results.")
-	flag.StringVar(&opts.Avoid, "avoid", "", "Introduces restrictions to the route.")
-	flag.StringVar(&opts.Units, "units", "", "Specifies the unit system to use when expressing distance as text.")
-	flag.StringVar(&opts.TransitRoutingPreference, "transit_routing_preference", "", "Specifies preferences for transit requests.")
-	flag.StringVar(&opts.TrafficModel, "traffic_model", "", "Specifies the assumptions to use when calculating time in traffic.")
-	flag.StringVar(&opts.TransitMode, "transit_mode", "", "Specifies one or more preferred modes of transit.")
+var commands = []command{
+	{"fetch", "[--] [<area corner> <area corner>]", "Fetch travel times between the cells of the area and the destinations.", fetchCommand},
+	{"run", "<job file>", "Fetch travel times as defined by a YAML job file, or fetch the results of a results file again.", runCommand},
+	{"render", "<results file>", "Render a results file to KML.", renderCommand},
+	{"diff", "<results file a> <results file b>", "Compare travel times of two results files cell by cell as CSV.", diffCommand},
+	{"stats", "<results file>", "Print travel time statistics per destination of a results file.", statsCommand},
+	{"merge", "<results file>...", "Merge results files of the same direction into one.", mergeCommand},
+}
 
+func main() {
+	flag.Usage = usage
 	flag.Parse()
 
-	var err error
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
 
-	if arrTimeStr != "" {
-		opts.ArrivalTime, err = time.ParseInLocation(timeLayout, arrTimeStr, time.Now().Location())
-		CheckErr(err, "Invalid arrivalTime")
+	for _, c := range commands {
+		if c.name == flag.Arg(0) {
+			c.run(flag.Args()[1:])
+			return
+		}
 	}
 
-	if depTimeStr != "" {
-		opts.DepartureTime, err = time.ParseInLocation(timeLayout, depTimeStr, time.Now().Location())
-		CheckErr(err, "Invalid depTimeStr")
+	fmt.Fprintf(flag.CommandLine.Output(), "unknown command %q\n\n", flag.Arg(0))
+	flag.Usage()
+	os.Exit(2)
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: transitcalc [logging flags] <command> [flags] [arguments]\n\ncommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-8s %s\n", c.name, c.description)
 	}
+	fmt.Fprintf(out, "\nRun transitcalc <command> -h for the command flags.\n\nlogging flags:\n")
+	flag.PrintDefaults()
+}
 
-	if renderKml {
-		if flag.NArg() != 1 {
-			glog.Fatal("No datafile specified")
-		}
+func (c command) run(args []string) {
+	fs := flag.NewFlagSet(c.name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: transitcalc %s [flags] %s\n\n%s\n\nflags:\n", c.name, c.args, c.description)
+		fs.PrintDefaults()
+	}
 
-		err = app.RenderKml(
-			flag.Arg(0),
-			time.Duration(maxDurationMins)*time.Minute,
-			3,
-		)
+	run := c.setup(fs)
+	fs.Parse(args)
+	run()
+}
 
-	} else {
-		if flag.NArg() != 2 {
-			glog.Fatal("No origin area specified")
-		}
+// usageFatal reports invalid command line arguments along with the command usage.
+func usageFatal(fs *flag.FlagSet, format string, args ...interface{}) {
+	fmt.Fprintf(fs.Output(), format+"\n\n", args...)
+	fs.Usage()
+	os.Exit(2)
+}
 
-		rectStart, err := PointFromString(flag.Arg(0))
-		CheckErr(err, "Invalid rectStart")
-		rectEnd, err := PointFromString(flag.Arg(1))
-		CheckErr(err, "Invalid rectEnd")
-		dest, err := PointFromString(destStr)
-		CheckErr(err, "Invalid rectEnd")
-
-		err = app.FetchResults(
-			apiKey,
-			dest,
-			rectStart,
-			rectEnd,
-			stepMeters,
-			opts,
-		)
-	}
+// stringList is a flag that may be repeated.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, "; ")
+}
 
-	CheckErr(err, "Failed to run app")
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
 }
 
 func CheckErr(err error, msg string) {
@@ -98,21 +101,37 @@ func CheckErr(err error, msg string) {
 	}
 }
 
-func PointFromString(s string) (ll s2.LatLng, err error) {
-	re := regexp.MustCompile(`(\d+\.\d+),\s*(\d+\.\d+)`)
-	parts := re.FindStringSubmatch(s)
-	if len(parts) != 3 {
-		return ll, fmt.Errorf("invalid point string: %q", s)
+func NewProvider(name, apiKey string, clientOptions []maps.ClientOption, gtfsFile string, walking app.WalkingModel, maxTransfers int) (app.TravelTimeProvider, error) {
+	switch name {
+	case "google":
+		return app.NewGoogleProvider(apiKey, clientOptions...)
+	case "gtfs":
+		return app.NewGtfsProvider(gtfsFile, walking, maxTransfers)
+	default:
+		return nil, fmt.Errorf("unknown provider %q", name)
 	}
+}
 
-	lat, err := strconv.ParseFloat(parts[1], 64)
+// PointsFromFile reads points or addresses, one per line. Blank lines and lines starting with # are skipped.
+func PointsFromFile(ctx context.Context, path string, resolver *app.PointResolver) ([]s2.LatLng, error) {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		return ll, errors.Wrap(err, "invalid lat")
+		return nil, errors.Wrap(err, fmt.Sprintf("failed to read file %q", path))
 	}
-	lon, err := strconv.ParseFloat(parts[2], 64)
-	if err != nil {
-		return ll, errors.Wrap(err, "invalid lon")
+
+	var points []s2.LatLng
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		ll, err := resolver.Resolve(ctx, line)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("line %d", i+1))
+		}
+		points = append(points, ll)
 	}
 
-	return s2.LatLngFromDegrees(lat, lon), nil
+	return points, nil
 }